@@ -0,0 +1,86 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// cacheEntry is the content of a URL cached on disk, with the validators used
+// to check whether it has changed since.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Content      []byte `json:"content"`
+}
+
+// cacheFile returns the file caching the given URL in dir.
+func cacheFile(dir, url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json")
+}
+
+// readCache returns the entry for the given URL in the cache in dir, or nil if
+// there's none.
+func readCache(dir, url string) (*cacheEntry, error) {
+	b, err := os.ReadFile(cacheFile(dir, url))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil || e.URL != url {
+		// corrupted entries are fetched again, and overwritten.
+		return nil, nil
+	}
+	return &e, nil
+}
+
+// writeCache writes the given entry in the cache in dir. The file is replaced
+// atomically, as other processes might be reading it, and only its owner can
+// read it.
+func writeCache(dir string, e *cacheEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cacheFile(dir, e.URL))
+}
@@ -15,7 +15,11 @@ package embedmd
 
 import (
 	"errors"
-	"path/filepath"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -29,12 +33,18 @@ type parseField struct {
 	plain string
 }
 
-type command struct {
+// A Command describes what content to embed and how to format it. Commands
+// are written either inline, as in [embedmd]:# (pathOrURL language), or as YAML
+// in the front matter of a document, using the field names in the yaml tags.
+type Command struct {
 	Path          string         `yaml:"src"`
 	Lang          string         `yaml:"lang,omitempty"`
 	Type          string         `yaml:"type"`
 	Start         *string        `yaml:"start"`
 	End           *string        `yaml:"end,omitempty"`
+	Lines         string         `yaml:"lines,omitempty"`
+	GoDecl        string         `yaml:"go,omitempty"`
+	Region        string         `yaml:"region,omitempty"`
 	IncludeStart  bool           `yaml:"includeStart"`
 	IncludeEnd    bool           `yaml:"includeEnd"`
 	Trim          bool           `yaml:"trim"`
@@ -57,21 +67,153 @@ const (
 	typeCode  = "code"
 )
 
-var flags = map[string]func(*command){
-	"noCode":  func(c *command) { c.Type = typePlain },
-	"noStart": func(c *command) { c.IncludeStart = false },
-	"noEnd":   func(c *command) { c.IncludeEnd = false },
-	"trim":    func(c *command) { c.Trim = true },
+var flags = map[string]func(*Command){
+	"noCode":  func(c *Command) { c.Type = typePlain },
+	"noStart": func(c *Command) { c.IncludeStart = false },
+	"noEnd":   func(c *Command) { c.IncludeEnd = false },
+	"trim":    func(c *Command) { c.Trim = true },
 }
 
-var options = map[string]func(string, *command){
-	"lang":       func(v string, c *command) { c.Lang = v },
-	"trimPrefix": func(v string, c *command) { c.TrimPrefix = v },
-	"trimSuffix": func(v string, c *command) { c.TrimSuffix = v },
-	"template":   func(v string, c *command) { c.Template = v },
+var options = map[string]func(string, *Command){
+	"lang":       func(v string, c *Command) { c.Lang = v },
+	"trimPrefix": func(v string, c *Command) { c.TrimPrefix = v },
+	"trimSuffix": func(v string, c *Command) { c.TrimSuffix = v },
+	"template":   func(v string, c *Command) { c.Template = v },
+	"lines":      func(v string, c *Command) { c.addLines(v) },
+	"region":     func(v string, c *Command) { c.Region = v },
 }
 
-func parseCommand(s string) (*command, error) {
+// lineRangeArg matches the inline form of a line range: L12, L12-L20 or L12-.
+var lineRangeArg = regexp.MustCompile(`^L(\d+)(-(L?(\d+))?)?$`)
+
+// addLines appends a comma separated list of line ranges to the command.
+func (c *Command) addLines(v string) {
+	if c.Lines != "" {
+		v = c.Lines + "," + v
+	}
+	c.Lines = v
+}
+
+// NewCommand returns a command embedding the whole file at the given path or
+// URL in a code block. Its fields can be modified to select only part of it.
+func NewCommand(path string) *Command {
+	return &Command{Path: path, Type: typeCode, IncludeStart: true, IncludeEnd: true}
+}
+
+// htmlPrefix and htmlSuffix delimit commands written as HTML comments.
+const (
+	htmlPrefix = "<!-- embedmd "
+	htmlSuffix = "-->"
+)
+
+// ParseCommand parses the inline form of a command, with or without the
+// leading [embedmd]:#, such as "[embedmd]:# (hello.go /func main/ $)", or
+// its HTML comment form, such as <!-- embedmd src=hello.go start="/func/" -->.
+func ParseCommand(s string) (*Command, error) {
+	s = strings.TrimSpace(s)
+	if rest, ok := strings.CutPrefix(s, htmlPrefix); ok {
+		if rest, ok = strings.CutSuffix(rest, htmlSuffix); !ok {
+			return nil, errors.New("missing end of HTML comment")
+		}
+		return parseHTMLCommand(rest)
+	}
+	if rest, ok := strings.CutPrefix(s, "[embedmd]:#"); ok {
+		s = rest
+	}
+	return parseCommand(s)
+}
+
+// htmlOptions are the keys accepted in HTML comments, in addition to options.
+var htmlOptions = map[string]func(string, *Command) error{
+	"src":   func(v string, c *Command) error { c.Path = v; return nil },
+	"type":  func(v string, c *Command) error { c.Type = v; return nil },
+	"start": func(v string, c *Command) error { c.Start = &v; return nil },
+	"end":   func(v string, c *Command) error { c.End = &v; return nil },
+	"go":    func(v string, c *Command) error { c.GoDecl = v; return nil },
+	"replace": func(v string, c *Command) error {
+		args, err := fields(v)
+		if err != nil {
+			return err
+		}
+		if len(args) != 1 || args[0].subs == nil {
+			return fmt.Errorf("invalid substitution %q", v)
+		}
+		c.Substitutions = append(c.Substitutions, *args[0].subs)
+		return nil
+	},
+	"includeStart": func(v string, c *Command) (err error) { c.IncludeStart, err = strconv.ParseBool(v); return err },
+	"includeEnd":   func(v string, c *Command) (err error) { c.IncludeEnd, err = strconv.ParseBool(v); return err },
+	"trim":         func(v string, c *Command) (err error) { c.Trim, err = strconv.ParseBool(v); return err },
+}
+
+// parseHTMLCommand parses a list of flags and key=value pairs, such as
+// src=hello.go noCode start="/func main/" end=$. Values can be written as Go
+// double quoted strings, so they can contain blanks, newlines or parenthesis.
+func parseHTMLCommand(s string) (*Command, error) {
+	cmd := NewCommand("")
+	for s = strings.TrimSpace(s); len(s) > 0; s = strings.TrimSpace(s) {
+		key := s
+		if i := strings.IndexAny(s, "= \t"); i >= 0 {
+			key = s[:i]
+		}
+		s = s[len(key):]
+
+		if !strings.HasPrefix(s, "=") {
+			f, ok := flags[key]
+			if !ok {
+				return nil, fmt.Errorf("unknown flag %q", key)
+			}
+			f(cmd)
+			continue
+		}
+
+		value, rest, err := htmlValue(s[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+		s = rest
+		if f, ok := options[key]; ok {
+			f(value, cmd)
+		} else if f, ok := htmlOptions[key]; ok {
+			if err := f(value, cmd); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+		} else {
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+
+	if cmd.Path == "" {
+		return nil, errors.New("missing file name")
+	}
+	if cmd.Type != typePlain && cmd.Type != typeCode {
+		return nil, fmt.Errorf("invalid type: %s", cmd.Type)
+	}
+	return cmd, nil
+}
+
+// htmlValue returns the value at the start of s, unquoting it if needed, and
+// the rest of s.
+func htmlValue(s string) (value, rest string, err error) {
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.IndexAny(s, " \t"); i >= 0 {
+			return s[:i], s[i:], nil
+		}
+		return s, "", nil
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err = strconv.Unquote(s[:i+1])
+			return value, s[i+1:], err
+		}
+	}
+	return "", "", errors.New("missing closing quote")
+}
+
+func parseCommand(s string) (*Command, error) {
 	s = replaceSpecial(strings.TrimSpace(s))
 	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
 		return nil, errors.New("argument list should be in parenthesis")
@@ -85,9 +227,33 @@ func parseCommand(s string) (*command, error) {
 		return nil, errors.New("missing file name")
 	}
 
-	cmd := &command{Path: args[0].plain, Type: typeCode, IncludeStart: true, IncludeEnd: true}
+	cmd := NewCommand(args[0].plain)
 	args = args[1:]
 
+	// line ranges and go declarations can appear anywhere after the file name.
+	rest := args[:0]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if kind, ok := strings.CutPrefix(arg.plain, "go:"); ok && goDeclKinds[kind] {
+			if i+1 == len(args) || args[i+1].plain == "" {
+				return nil, fmt.Errorf("missing name after %s", arg.plain)
+			}
+			i++
+			cmd.GoDecl = kind + " " + args[i].plain
+			continue
+		}
+		if m := lineRangeArg.FindStringSubmatch(arg.plain); arg.subs == nil && m != nil {
+			spec := m[1]
+			if m[2] != "" {
+				spec += "-" + m[4]
+			}
+			cmd.addLines(spec)
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	args = rest
+
 	for {
 		if len(args) > 0 {
 			arg := args[0].plain
@@ -110,16 +276,9 @@ func parseCommand(s string) (*command, error) {
 		}
 	}
 
-	if cmd.Lang == "" {
-		if len(args) > 0 && args[0].plain != "" && args[0].plain[0] != '/' {
-			cmd.Lang, args = args[0].plain, args[1:]
-		} else {
-			ext := filepath.Ext(cmd.Path[1:])
-			if len(ext) == 0 {
-				return nil, errors.New("language is required when file has no extension")
-			}
-			cmd.Lang = ext[1:]
-		}
+	// without a language, it's inferred when the command is run.
+	if cmd.Lang == "" && len(args) > 0 && args[0].plain != "" && args[0].plain[0] != '/' {
+		cmd.Lang, args = args[0].plain, args[1:]
 	}
 
 	for {
@@ -143,6 +302,185 @@ func parseCommand(s string) (*command, error) {
 	return cmd, nil
 }
 
+// String returns the inline form of the command, as in
+// [embedmd]:# (pathOrURL language /start regexp/ /end regexp/), or its HTML
+// comment form, as in <!-- embedmd src=pathOrURL template="{{ .Content }}" -->,
+// when the inline form can't hold its values, such as ones with blanks. Either
+// way, ParseCommand returns the same command from it.
+func (c *Command) String() string {
+	want := c.inline()
+	if s := want.inlineString(); roundTrips(s, want) {
+		return s
+	}
+	return want.htmlString()
+}
+
+// inline returns a copy of the command with regular expressions surrounded by
+// slashes, as in the inline and HTML comment forms.
+func (c *Command) inline() *Command {
+	in := *c
+	in.yamlMode = false
+	if c.yamlMode {
+		in.Start, in.End = addSlashes(c.Start), addSlashes(c.End)
+	}
+	if len(in.Substitutions) == 0 {
+		in.Substitutions = nil
+	}
+	return &in
+}
+
+func addSlashes(s *string) *string {
+	if s == nil || *s == "$" {
+		return s
+	}
+	re := "/" + escapeSlash(*s) + "/"
+	return &re
+}
+
+// roundTrips reports whether s is parsed as the given command.
+func roundTrips(s string, c *Command) bool {
+	parsed, err := ParseCommand(s)
+	return err == nil && reflect.DeepEqual(parsed, c)
+}
+
+func (c *Command) inlineString() string {
+	args := []string{c.Path}
+	if c.Type == typePlain {
+		args = append(args, "noCode")
+	}
+	if !c.IncludeStart {
+		args = append(args, "noStart")
+	}
+	if !c.IncludeEnd {
+		args = append(args, "noEnd")
+	}
+	if c.Trim {
+		args = append(args, "trim")
+	}
+	for _, o := range []struct{ key, value string }{
+		{"trimPrefix", c.TrimPrefix},
+		{"trimSuffix", c.TrimSuffix},
+		{"template", c.Template},
+		{"region", c.Region},
+	} {
+		if o.value != "" {
+			args = append(args, o.key+":"+escapeSpecial(o.value))
+		}
+	}
+	if c.Lang != "" {
+		args = append(args, c.Lang)
+	}
+	if c.Lines != "" {
+		for _, r := range strings.Split(c.Lines, ",") {
+			from, to, isRange := strings.Cut(strings.TrimSpace(r), "-")
+			arg := "L" + from
+			if isRange {
+				arg += "-"
+				if to != "" {
+					arg += "L" + to
+				}
+			}
+			args = append(args, arg)
+		}
+	}
+	if c.GoDecl != "" {
+		args = append(args, "go:"+c.GoDecl)
+	}
+	for _, sub := range c.Substitutions {
+		args = append(args, "s/"+escapeSpecial(escapeSlash(sub.Pattern))+"/"+escapeSpecial(escapeSlash(sub.Replacement))+"/")
+	}
+	// an end regexp without a start one can't be written inline.
+	if c.Start != nil {
+		args = append(args, escapeSpecial(*c.Start))
+		if c.End != nil {
+			args = append(args, escapeSpecial(*c.End))
+		}
+	}
+	return "[embedmd]:# (" + strings.Join(args, " ") + ")"
+}
+
+func (c *Command) htmlString() string {
+	args := []string{"src=" + htmlQuote(c.Path)}
+	if c.Type == typePlain {
+		args = append(args, "noCode")
+	}
+	if !c.IncludeStart {
+		args = append(args, "noStart")
+	}
+	if !c.IncludeEnd {
+		args = append(args, "noEnd")
+	}
+	if c.Trim {
+		args = append(args, "trim")
+	}
+	for _, o := range []struct{ key, value string }{
+		{"lang", c.Lang},
+		{"trimPrefix", c.TrimPrefix},
+		{"trimSuffix", c.TrimSuffix},
+		{"template", c.Template},
+		{"region", c.Region},
+		{"lines", c.Lines},
+		{"go", c.GoDecl},
+	} {
+		if o.value != "" {
+			args = append(args, o.key+"="+htmlQuote(o.value))
+		}
+	}
+	for _, sub := range c.Substitutions {
+		args = append(args, "replace="+htmlQuote("s/"+escapeSlash(sub.Pattern)+"/"+escapeSlash(sub.Replacement)+"/"))
+	}
+	if c.Start != nil {
+		args = append(args, "start="+htmlQuote(*c.Start))
+	}
+	if c.End != nil {
+		args = append(args, "end="+htmlQuote(*c.End))
+	}
+	return htmlPrefix + strings.Join(args, " ") + " " + htmlSuffix
+}
+
+// htmlQuote quotes the given value of an HTML comment command if needed.
+func htmlQuote(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\n\r\"\\") || strings.Contains(v, htmlSuffix) {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// MarshalYAML returns the YAML form of the command, where regular expressions
+// are not surrounded by slashes.
+func (c Command) MarshalYAML() (interface{}, error) {
+	type plain Command
+	p := plain(c)
+	if !c.yamlMode {
+		p.Start, p.End = trimSlashes(c.Start), trimSlashes(c.End)
+	}
+	return p, nil
+}
+
+// UnmarshalYAML parses the YAML form of a command, using the same defaults as
+// the inline form.
+func (c *Command) UnmarshalYAML(value *yaml.Node) error {
+	type plain Command
+	p := plain(*NewCommand(""))
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	if p.Type != typePlain && p.Type != typeCode {
+		return fmt.Errorf("invalid type: %s", p.Type)
+	}
+	*c = Command(p)
+	c.yamlMode = true
+	return nil
+}
+
+func trimSlashes(s *string) *string {
+	if s == nil || len(*s) < 2 || (*s)[0] != '/' || (*s)[len(*s)-1] != '/' {
+		return s
+	}
+	re := unescapeSlash((*s)[1 : len(*s)-1])
+	return &re
+}
+
 // fields returns a list of the groups of text separated by blanks,
 // keeping all text surrounded by / as a group.
 func fields(s string) ([]parseField, error) {
@@ -186,6 +524,15 @@ func fields(s string) ([]parseField, error) {
 func unescapeSlash(s string) string {
 	return strings.ReplaceAll(s, "\\/", "/")
 }
+
+func escapeSlash(s string) string {
+	return strings.ReplaceAll(unescapeSlash(s), "/", "\\/")
+}
+
+func escapeSpecial(s string) string {
+	return strings.ReplaceAll(s, "\n", "$embed:{newline}")
+}
+
 func replaceSpecial(s string) string {
 	for k, v := range specials {
 		s = strings.ReplaceAll(s, k, v)
@@ -15,6 +15,7 @@ package embedmd
 
 import (
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 	"testing"
 )
 
@@ -22,36 +23,36 @@ func TestParseCommand(t *testing.T) {
 	tc := []struct {
 		name string
 		in   string
-		cmd  command
+		cmd  Command
 		err  string
 	}{
 		{name: "start to end",
 			in:  "(code.go /start/ /end/)",
-			cmd: command{Path: "code.go", Lang: "go", Start: ptr("/start/"), End: ptr("/end/"), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "code.go", Start: ptr("/start/"), End: ptr("/end/"), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "start with replace",
 			in:  "(code.go s/.*/b/ /start/ /end/)",
-			cmd: command{Path: "code.go", Lang: "go", Start: ptr("/start/"), End: ptr("/end/"), Substitutions: []Substitution{{Pattern: ".*", Replacement: "b"}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "code.go", Start: ptr("/start/"), End: ptr("/end/"), Substitutions: []Substitution{{Pattern: ".*", Replacement: "b"}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "start with replace with space, escape /, unescape \n in replacement",
 			in:  "(code.go s/.* /$embed:{newline}b\\/ / /start/ /end/)",
-			cmd: command{Path: "code.go", Lang: "go", Start: ptr("/start/"), End: ptr("/end/"), Substitutions: []Substitution{{Pattern: ".* ", Replacement: "\nb/ "}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "code.go", Start: ptr("/start/"), End: ptr("/end/"), Substitutions: []Substitution{{Pattern: ".* ", Replacement: "\nb/ "}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "only start",
 			in:  "(code.go     /start/)",
-			cmd: command{Path: "code.go", Lang: "go", Start: ptr("/start/"), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "code.go", Start: ptr("/start/"), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "only start with replace",
 			in:  "(code.go s/.*/b/    /start/)",
-			cmd: command{Path: "code.go", Lang: "go", Start: ptr("/start/"), Substitutions: []Substitution{{Pattern: ".*", Replacement: "b"}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "code.go", Start: ptr("/start/"), Substitutions: []Substitution{{Pattern: ".*", Replacement: "b"}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "empty list",
 			in:  "()",
 			err: "missing file name"},
 		{name: "file with no extension and no lang",
 			in:  "(test)",
-			err: "language is required when file has no extension"},
+			cmd: Command{Path: "test", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "surrounding blanks",
 			in:  "   \t  (code.go)  \t  ",
-			cmd: command{Path: "code.go", Lang: "go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "code.go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "all options",
 			in: "(code.go noCode noStart noEnd trim trimSuffix:suffix trimPrefix:prefix template:template lang:md s/from/to/ /start/ /end/)",
-			cmd: command{
+			cmd: Command{
 				Path:         "code.go",
 				Lang:         "md",
 				Type:         typePlain,
@@ -82,27 +83,48 @@ func TestParseCommand(t *testing.T) {
 			err: "unbalanced /"},
 		{name: "file name and language",
 			in:  "(test.md markdown)",
-			cmd: command{Path: "test.md", Lang: "markdown", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "test.md", Lang: "markdown", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "file name and language with replace",
 			in:  "(test.md markdown s/.*/b/)",
-			cmd: command{Path: "test.md", Lang: "markdown", Substitutions: []Substitution{{Pattern: ".*", Replacement: "b"}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "test.md", Lang: "markdown", Substitutions: []Substitution{{Pattern: ".*", Replacement: "b"}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "multi-line comments",
 			in:  `(doc.go /\/\*/ /\*\//)`,
-			cmd: command{Path: "doc.go", Lang: "go", Start: ptr(`/\/\*/`), End: ptr(`/\*\//`), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "doc.go", Start: ptr(`/\/\*/`), End: ptr(`/\*\//`), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "using $ as end",
 			in:  "(foo.go /start/ $)",
-			cmd: command{Path: "foo.go", Lang: "go", Start: ptr("/start/"), End: ptr("$"), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "foo.go", Start: ptr("/start/"), End: ptr("$"), Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "extra arguments",
 			in: "(foo.go /start/ $ extra)", err: "too many arguments"},
 		{name: "file name with directories",
 			in:  "(foo/bar.go)",
-			cmd: command{Path: "foo/bar.go", Lang: "go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "foo/bar.go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "url",
 			in:  "(http://golang.org/sample.go)",
-			cmd: command{Path: "http://golang.org/sample.go", Lang: "go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "http://golang.org/sample.go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "line range",
+			in:  "(code.go L12-L20)",
+			cmd: Command{Path: "code.go", Lines: "12-20", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "several line ranges with language and flags",
+			in:  "(code.go noStart go L1 L12- L3-5)",
+			cmd: Command{Path: "code.go", Lang: "go", Lines: "1,12-,3-5", Type: typeCode, IncludeStart: false, IncludeEnd: true}},
+		{name: "line range option",
+			in:  "(code.go lines:12-20,30-)",
+			cmd: Command{Path: "code.go", Lines: "12-20,30-", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "go declaration",
+			in:  "(code.go go:method embedder.runCommand)",
+			cmd: Command{Path: "code.go", GoDecl: "method embedder.runCommand", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "go declaration with language",
+			in:  "(code.txt go go:func main)",
+			cmd: Command{Path: "code.txt", Lang: "go", GoDecl: "func main", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "go declaration without name",
+			in:  "(code.go go:type)",
+			err: "missing name after go:type"},
+		{name: "region",
+			in:  "(code.go region:snippet_name)",
+			cmd: Command{Path: "code.go", Region: "snippet_name", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 		{name: "bad url",
 			in:  "(http://golang:org:sample.go)",
-			cmd: command{Path: "http://golang:org:sample.go", Lang: "go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+			cmd: Command{Path: "http://golang:org:sample.go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
 	}
 
 	for _, tt := range tc {
@@ -116,6 +138,151 @@ func TestParseCommand(t *testing.T) {
 	}
 }
 
+func TestParseHTMLCommand(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+		cmd  Command
+		err  string
+	}{
+		{name: "file only",
+			in:  "<!-- embedmd src=code.go -->",
+			cmd: Command{Path: "code.go", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "quoted values",
+			in:  `<!-- embedmd src=code.go lang=go start="/func main() {/" end=$ replace="s/a b/(c)/" template="{{ .Content }}\n" -->`,
+			cmd: Command{Path: "code.go", Lang: "go", Start: ptr("/func main() {/"), End: ptr("$"), Template: "{{ .Content }}\n", Substitutions: []Substitution{{Pattern: "a b", Replacement: "(c)"}}, Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "flags and options",
+			in:  `<!-- embedmd noCode src=test lang=markdown includeEnd=false lines=1-3,7 trimPrefix="# " go="func main" region=snippet -->`,
+			cmd: Command{Path: "test", Lang: "markdown", Lines: "1-3,7", TrimPrefix: "# ", GoDecl: "func main", Region: "snippet", Type: typePlain, IncludeStart: true, IncludeEnd: false}},
+		{name: "missing file name",
+			in:  "<!-- embedmd lang=go -->",
+			err: "missing file name"},
+		{name: "no language",
+			in:  "<!-- embedmd src=test -->",
+			cmd: Command{Path: "test", Type: typeCode, IncludeStart: true, IncludeEnd: true}},
+		{name: "unknown flag",
+			in:  "<!-- embedmd src=code.go potato -->",
+			err: `unknown flag "potato"`},
+		{name: "unknown option",
+			in:  "<!-- embedmd src=code.go potato=1 -->",
+			err: `unknown option "potato"`},
+		{name: "unclosed quote",
+			in:  `<!-- embedmd src="code.go -->`,
+			err: "invalid value for src: missing closing quote"},
+		{name: "bad boolean",
+			in:  `<!-- embedmd src=code.go trim=maybe -->`,
+			err: `invalid value for trim: strconv.ParseBool: parsing "maybe": invalid syntax`},
+		{name: "unterminated comment",
+			in:  "<!-- embedmd src=code.go",
+			err: "missing end of HTML comment"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseCommand(tt.in)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			assert.Equal(t, tt.cmd, *cmd)
+		})
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	tc := []string{
+		"[embedmd]:# (code.go)",
+		"[embedmd]:# (code.go /start/ /end/)",
+		"[embedmd]:# (code.go /start/ $)",
+		"[embedmd]:# (test.md markdown)",
+		"[embedmd]:# (code.go noCode noStart noEnd trim trimPrefix:prefix trimSuffix:suffix template:template md s/from/to/ /start/ /end/)",
+		"[embedmd]:# (code.go s/a\\/b/$embed:{newline}/ /func main()/)",
+		"[embedmd]:# (code.go L1 L12- L3-L5)",
+		"[embedmd]:# (code.go go:method embedder.runCommand)",
+		"[embedmd]:# (code.go region:snippet_name)",
+	}
+
+	for _, in := range tc {
+		t.Run(in, func(t *testing.T) {
+			cmd, err := ParseCommand(in)
+			assert.NoError(t, err)
+			assert.Equal(t, in, cmd.String())
+		})
+	}
+}
+
+func TestCommandStringRoundTrip(t *testing.T) {
+	tc := []struct {
+		name string
+		cmd  func(*Command)
+		out  string
+	}{
+		{name: "template with blanks",
+			cmd: func(c *Command) { c.Template = "{{ .Content }}" },
+			out: `<!-- embedmd src=code.go template="{{ .Content }}" -->`},
+		{name: "trim prefix with a trailing blank",
+			cmd: func(c *Command) { c.TrimPrefix = "# " },
+			out: `<!-- embedmd src=code.go trimPrefix="# " -->`},
+		{name: "end without start",
+			cmd: func(c *Command) { c.End = ptr("/end/") },
+			out: `<!-- embedmd src=code.go end=/end/ -->`},
+		{name: "path with blanks",
+			cmd: func(c *Command) { c.Path = "my code.go"; c.Type = typePlain; c.Start = ptr("/a b/") },
+			out: `<!-- embedmd src="my code.go" noCode start="/a b/" -->`},
+		{name: "start not looking like a regexp without a language",
+			cmd: func(c *Command) { c.Start = ptr("$") },
+			out: `<!-- embedmd src=code.go start=$ -->`},
+		{name: "yaml regexps",
+			cmd: func(c *Command) { c.Start, c.End, c.yamlMode = ptr("func main() {"), ptr("^}"), true },
+			out: `[embedmd]:# (code.go /func main() {/ /^}/)`},
+		{name: "substitution with blanks and newlines",
+			cmd: func(c *Command) { c.Substitutions = []Substitution{{Pattern: "a b", Replacement: "c\nd"}} },
+			out: "[embedmd]:# (code.go s/a b/c$embed:{newline}d/)"},
+		{name: "empty substitutions",
+			cmd: func(c *Command) { c.Substitutions = []Substitution{} },
+			out: "[embedmd]:# (code.go)"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := NewCommand("code.go")
+			tt.cmd(cmd)
+			assert.Equal(t, tt.out, cmd.String())
+			parsed, err := ParseCommand(cmd.String())
+			assert.NoError(t, err)
+			assert.Equal(t, cmd.inline(), parsed)
+		})
+	}
+}
+
+func TestCommandYAML(t *testing.T) {
+	cmd := NewCommand("code.go")
+	cmd.Type = typePlain
+	cmd.Start, cmd.End = ptr("/a\\/b/"), ptr("$")
+	cmd.Substitutions = []Substitution{{Pattern: "from", Replacement: "to"}}
+
+	b, err := yaml.Marshal(cmd)
+	assert.NoError(t, err)
+	assert.Equal(t, `src: code.go
+type: plain
+start: a/b
+end: $
+includeStart: true
+includeEnd: true
+trim: false
+replace:
+    - pattern: from
+      replacement: to
+`, string(b))
+
+	var got Command
+	assert.NoError(t, yaml.Unmarshal(b, &got))
+	assert.Equal(t, "[embedmd]:# (code.go noCode s/from/to/ /a\\/b/ $)", got.String())
+	assert.Equal(t, cmd.String(), got.String())
+
+	err = yaml.Unmarshal([]byte("src: code.go\ntype: potato\n"), &got)
+	assert.EqualError(t, err, "invalid type: potato")
+}
+
 func ptr(s string) *string { return &s }
 
 func str(s *string) string {
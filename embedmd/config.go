@@ -0,0 +1,195 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigFile is the name of the project configuration file, which is searched
+// for in the directory of the processed files and its parents.
+const ConfigFile = ".embedmd.yaml"
+
+// A Config is the configuration of a project, as read from a ConfigFile:
+//
+//	mounts:
+//	  lgtm: https://raw.githubusercontent.com/grafana/docker-otel-lgtm/main
+//	  shared: ../shared
+//	languages:
+//	  .tpl: gotemplate
+//	templates:
+//	  goget: "go get {{ .Content }}"
+//	include: ["docs/**/*.md"]
+//	exclude: ["docs/drafts/**"]
+//	flags: ["-d"]
+//	http:
+//	  timeout: 10s
+//	  cacheDir: .cache/embedmd
+//	  headers:
+//	    docs.example.com:
+//	      Authorization: Bearer ${DOCS_TOKEN}
+//
+// Mounts are used as $name, and relative paths in them are relative to Dir.
+// Templates can be used by name in the template option of commands, or called
+// from other templates. Include and Exclude are globs, relative to Dir, of the
+// files to process, where ** matches any number of directories. Flags are the
+// default command line flags of the embedmd command, which only reads them from
+// the configuration found from the current directory and ignores them in the
+// configurations of the processed files. HTTP holds the options to fetch URLs,
+// which are used with NewFetcher once a relative CacheDir is resolved from Dir.
+type Config struct {
+	Dir       string            `yaml:"-"`
+	Mounts    map[string]string `yaml:"mounts"`
+	Languages map[string]string `yaml:"languages"`
+	Templates map[string]string `yaml:"templates"`
+	Include   []string          `yaml:"include"`
+	Exclude   []string          `yaml:"exclude"`
+	Flags     []string          `yaml:"flags"`
+	HTTP      HTTPOptions       `yaml:"http"`
+}
+
+// LoadConfig reads the configuration in the given file.
+func LoadConfig(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{Dir: dir}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, glob := range append(c.Include, c.Exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(glob, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid glob %q", file, glob)
+		}
+	}
+	return c, nil
+}
+
+// FindConfig returns the configuration in the closest ConfigFile in the given
+// directory or its parents, or nil if there is none.
+func FindConfig(dir string) (*Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		c, err := LoadConfig(filepath.Join(dir, ConfigFile))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return c, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Includes reports whether the file at the given path should be processed,
+// which is when it matches one of the Include globs, if any, and none of the
+// Exclude ones. Files out of Dir are not affected by the globs.
+func (c *Config) Includes(file string) bool {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(c.Dir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+	for _, glob := range c.Exclude {
+		if MatchGlob(glob, rel) {
+			return false
+		}
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	for _, glob := range c.Include {
+		if MatchGlob(glob, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchGlob reports whether the slash separated name matches the glob, where
+// a ** element matches any number of path elements and the other ones are
+// matched with path.Match.
+func MatchGlob(glob, name string) bool {
+	return matchElems(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// WithConfig uses the mounts, languages and templates of the given
+// configuration. Options are applied in order, so the ones following it
+// override its languages and templates, and the mounts given to Process take
+// precedence over the ones in the configuration.
+func WithConfig(c *Config) Option {
+	return Option{func(e *embedder) {
+		WithLanguages(c.Languages).f(e)
+		if e.templates == nil {
+			e.templates = map[string]string{}
+		}
+		for name, t := range c.Templates {
+			e.templates[name] = t
+		}
+		if e.configMounts == nil {
+			e.configMounts = map[string]string{}
+		}
+		for name, target := range c.Mounts {
+			if !isURL(target) && !filepath.IsAbs(target) {
+				target = filepath.Join(c.Dir, filepath.FromSlash(target))
+				if abs, err := filepath.Abs(target); err == nil {
+					target = abs
+				}
+				target = filepath.ToSlash(target)
+			}
+			e.configMounts["$"+strings.TrimPrefix(name, "$")] = target
+		}
+	}}
+}
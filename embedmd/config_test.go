@@ -0,0 +1,134 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `mounts:
+  shared: ../shared
+  lgtm: https://example.com/lgtm
+languages:
+  .tpl: gotemplate
+templates:
+  goget: "go get {{ .Content }}"
+  quoted: '"{{ .Content }}"'
+include: ["docs/**/*.md", "*.md"]
+exclude: ["docs/drafts/**"]
+flags: ["-d"]
+`
+
+func TestFindConfig(t *testing.T) {
+	root := t.TempDir()
+	project := filepath.Join(root, "project")
+	docs := filepath.Join(project, "docs", "guides")
+	assert.NoError(t, os.MkdirAll(docs, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(project, ConfigFile), []byte(testConfig), 0644))
+
+	c, err := FindConfig(docs)
+	assert.NoError(t, err)
+	if assert.NotNil(t, c) {
+		assert.Equal(t, project, c.Dir)
+		assert.Equal(t, map[string]string{"shared": "../shared", "lgtm": "https://example.com/lgtm"}, c.Mounts)
+		assert.Equal(t, []string{"-d"}, c.Flags)
+	}
+
+	c, err = FindConfig(root)
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(docs, ConfigFile), []byte("mounts: [potato]\n"), 0644))
+	_, err = FindConfig(docs)
+	assert.ErrorContains(t, err, filepath.Join(docs, ConfigFile)+": yaml: unmarshal errors")
+}
+
+func TestConfigIncludes(t *testing.T) {
+	dir := t.TempDir()
+	tc := []struct {
+		include, exclude []string
+		file             string
+		want             bool
+	}{
+		{file: "README.md", want: true},
+		{include: []string{"*.md"}, file: "README.md", want: true},
+		{include: []string{"*.md"}, file: "docs/README.md", want: false},
+		{include: []string{"docs/**/*.md"}, file: "docs/README.md", want: true},
+		{include: []string{"docs/**/*.md"}, file: "docs/a/b/README.md", want: true},
+		{include: []string{"docs/**/*.md"}, file: "other/README.md", want: false},
+		{exclude: []string{"docs/drafts/**"}, file: "docs/drafts/a/wip.md", want: false},
+		{exclude: []string{"**/vendor/**"}, file: "vendor/README.md", want: false},
+		{include: []string{"*.md"}, file: "../outside/README.md", want: true},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.file, func(t *testing.T) {
+			c := &Config{Dir: dir, Include: tt.include, Exclude: tt.exclude}
+			assert.Equal(t, tt.want, c.Includes(filepath.Join(dir, filepath.FromSlash(tt.file))))
+		})
+	}
+}
+
+func TestProcessWithConfig(t *testing.T) {
+	c := &Config{
+		Dir:       "/project",
+		Mounts:    map[string]string{"shared": "../shared", "lgtm": "https://example.com/lgtm", "abs": "/abs"},
+		Languages: map[string]string{".tpl": "gotemplate"},
+		Templates: map[string]string{"goget": "go get {{ .Content }}", "quoted": `"{{ .Content }}"`},
+	}
+	files := fakeFileProvider{
+		"/shared/page.tpl": []byte("{{ . }}\n"),
+		"/abs/mod":         []byte("module\n"),
+		"/override/mod":    []byte("overridden\n"),
+	}
+	tc := []struct {
+		name   string
+		in     string
+		mounts map[string]string
+		opts   []Option
+		out    string
+	}{
+		{name: "mount relative to the configuration and language",
+			in:  "[embedmd]:# ($shared/page.tpl)\n",
+			out: "[embedmd]:# ($shared/page.tpl)\n```gotemplate\n{{ . }}\n```\n"},
+		{name: "absolute mount and named template",
+			in:  "<!-- embedmd src=$abs/mod noCode trim template=goget -->\n",
+			out: "<!-- embedmd src=$abs/mod noCode trim template=goget -->\ngo get module\n<!-- embedmd-end -->\n"},
+		{name: "named template called from a template",
+			in:  "<!-- embedmd src=$abs/mod noCode trim template=\"{{ template \\\"quoted\\\" . }}\" -->\n",
+			out: "<!-- embedmd src=$abs/mod noCode trim template=\"{{ template \\\"quoted\\\" . }}\" -->\n\"module\"\n<!-- embedmd-end -->\n"},
+		{name: "explicit mounts take precedence",
+			in:     "[embedmd]:# ($abs/mod text)\n",
+			mounts: map[string]string{"$abs": "/override"},
+			out:    "[embedmd]:# ($abs/mod text)\n```text\noverridden\n```\n"},
+		{name: "later options take precedence",
+			in:   "[embedmd]:# ($shared/page.tpl)\n",
+			opts: []Option{WithLanguages(map[string]string{".tpl": "tpl"})},
+			out:  "[embedmd]:# ($shared/page.tpl)\n```tpl\n{{ . }}\n```\n"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithFetcher(files), WithConfig(c)}, tt.opts...)
+			var out bytes.Buffer
+			assert.NoError(t, Process(&out, strings.NewReader(tt.in), tt.mounts, opts...))
+			assert.Equal(t, tt.out, out.String())
+		})
+	}
+}
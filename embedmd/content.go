@@ -14,11 +14,18 @@
 package embedmd
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Fetcher provides an abstraction on a file system.
@@ -27,25 +34,409 @@ import (
 // The first parameter is the base directory that could be used to resolve
 // relative paths. This base directory will be ignored for absolute paths,
 // such as URLs.
+// Fetch is called concurrently, as the content of all the commands in a
+// document is fetched at once, so implementations must be safe for concurrent
+// use.
 type Fetcher interface {
 	Fetch(dir, path string) ([]byte, error)
 }
 
-type fetcher struct{}
+// HTTPOptions configures how URLs are fetched by the Fetcher returned by
+// NewFetcher. Zero values are replaced by the ones in DefaultHTTPOptions.
+type HTTPOptions struct {
+	// Timeout of each attempt to fetch a URL.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries after network errors or 5xx and 429 responses, the first one
+	// after waiting Backoff, which is doubled for each of the next ones.
+	// Negative values disable them.
+	Retries int           `yaml:"retries"`
+	Backoff time.Duration `yaml:"backoff"`
+	// MaxSize is the maximum size of the content of a URL, in bytes.
+	MaxSize int64 `yaml:"maxSize"`
+	// Headers are added to the requests to each host, usually to authenticate
+	// with an Authorization header. $VAR and ${VAR} in their values are
+	// replaced by the environment variable VAR. Requests to GitHub hosts use
+	// the GITHUB_TOKEN environment variable, if set, when they're fetched
+	// over https and have no Authorization header.
+	Headers map[string]map[string]string `yaml:"headers"`
+	// CacheDir is the directory where the content of URLs is cached, so it's
+	// only downloaded again when the server reports it changed, by its ETag
+	// or Last-Modified headers. Nothing is cached if empty.
+	CacheDir string `yaml:"cacheDir"`
+	// CacheAuthenticated caches the content of URLs fetched with an
+	// Authorization header too, which is otherwise never cached as the cache
+	// isn't encrypted.
+	CacheAuthenticated bool `yaml:"cacheAuthenticated"`
+	// Offline makes URLs be read only from the cache, with an error for the
+	// ones missing from it.
+	Offline bool `yaml:"offline"`
+	// Client is used for the requests, or http.DefaultClient if nil.
+	Client *http.Client `yaml:"-"`
+}
+
+// DefaultHTTPOptions are the options used by default to fetch URLs.
+var DefaultHTTPOptions = HTTPOptions{
+	Timeout: 30 * time.Second,
+	Retries: 3,
+	Backoff: time.Second,
+	MaxSize: 16 << 20,
+}
+
+// githubHosts are the hosts using GITHUB_TOKEN by default.
+var githubHosts = map[string]bool{
+	"github.com":                true,
+	"api.github.com":            true,
+	"raw.githubusercontent.com": true,
+}
+
+// NewFetcher returns a Fetcher reading local files and fetching URLs over
+// HTTP with the given options, as the default Fetcher does. file:// and data:
+// URLs are supported too.
+func NewFetcher(o HTTPOptions) Fetcher {
+	return fetcher{http: o}
+}
 
-func (fetcher) Fetch(dir, path string) ([]byte, error) {
-	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
-		path = filepath.Join(dir, filepath.FromSlash(path))
-		return ioutil.ReadFile(path)
+type fetcher struct {
+	http HTTPOptions
+}
+
+func (f fetcher) Fetch(dir, path string) ([]byte, error) {
+	if s, ok := schemes[urlScheme(path)]; ok {
+		return s.Fetch(dir, path)
+	}
+	if !isURL(path) {
+		return ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
 	}
 
-	res, err := http.Get(path)
+	o := f.http.withDefaults()
+	cacheDir := o.CacheDir
+	if cacheDir != "" && !o.CacheAuthenticated && o.authenticated(path) {
+		cacheDir = ""
+	}
+	var cached *cacheEntry
+	if cacheDir != "" {
+		var err error
+		if cached, err = readCache(cacheDir, path); err != nil {
+			return nil, err
+		}
+	}
+	if o.Offline {
+		if o.CacheDir != "" && cacheDir == "" {
+			return nil, fmt.Errorf("%s is fetched with credentials, so it's not cached without cacheAuthenticated, and can't be fetched offline", path)
+		}
+		if cacheDir == "" {
+			return nil, fmt.Errorf("%s can't be fetched offline without a cache", path)
+		}
+		if cached == nil {
+			return nil, fmt.Errorf("%s is not in the cache in %s, and can't be fetched offline", path, cacheDir)
+		}
+		return cached.Content, nil
+	}
+
+	wait := o.Backoff
+	for attempt := 0; ; attempt++ {
+		e, retry, err := o.get(path, cached)
+		if err == nil {
+			if cacheDir != "" && e != cached {
+				// failing to cache the content doesn't prevent using it.
+				writeCache(cacheDir, e)
+			}
+			return e.Content, nil
+		}
+		if !retry || attempt >= o.Retries {
+			return nil, err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (o HTTPOptions) withDefaults() HTTPOptions {
+	if o.Timeout == 0 {
+		o.Timeout = DefaultHTTPOptions.Timeout
+	}
+	if o.Retries == 0 {
+		o.Retries = DefaultHTTPOptions.Retries
+	}
+	if o.Backoff == 0 {
+		o.Backoff = DefaultHTTPOptions.Backoff
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = DefaultHTTPOptions.MaxSize
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	return o
+}
+
+// get fetches the given URL once, reporting whether it's worth trying again
+// when it fails. The cached entry, if any, is returned if the content hasn't
+// changed since it was cached.
+func (o HTTPOptions) get(url string, cached *cacheEntry) (e *cacheEntry, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	o.addHeaders(req)
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	res, err := o.Client.Do(req)
+	if err != nil {
+		return nil, true, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		return cached, false, nil
+	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status %s", res.Status)
+		retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("status %s", res.Status)
+	}
+	if res.ContentLength > o.MaxSize {
+		return nil, false, fmt.Errorf("content is larger than %d bytes", o.MaxSize)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, o.MaxSize+1))
+	if err != nil {
+		return nil, true, err
+	}
+	if int64(len(b)) > o.MaxSize {
+		return nil, false, fmt.Errorf("content is larger than %d bytes", o.MaxSize)
+	}
+	return &cacheEntry{
+		URL:          url,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Content:      b,
+	}, false, nil
+}
+
+// authenticated reports whether the requests to the given URL have an
+// Authorization header.
+func (o HTTPOptions) authenticated(url string) bool {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	o.addHeaders(req)
+	return req.Header.Get("Authorization") != ""
+}
+
+func (o HTTPOptions) addHeaders(req *http.Request) {
+	headers, ok := o.Headers[req.URL.Host]
+	if !ok {
+		headers = o.Headers[req.URL.Hostname()]
+	}
+	for k, v := range headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	// the token is never sent in the clear, over http.
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" && req.URL.Scheme == "https" && githubHosts[req.URL.Hostname()] && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+}
+
+// schemes are the Fetchers of the URLs with a scheme other than http and https
+// supported by the default Fetcher. More can be added with WithScheme.
+var schemes = map[string]Fetcher{
+	"file": fileFetcher{},
+	"data": dataFetcher{},
+}
+
+// urlScheme returns the scheme of the given path, in lower case, or "" if it
+// has none. Single letters are drive names on Windows, rather than schemes.
+func urlScheme(path string) string {
+	for i, c := range path {
+		switch {
+		case c == ':' && i > 1:
+			return strings.ToLower(path[:i])
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// isURL reports whether the given path is a URL supported by the default
+// Fetcher, rather than a file path.
+func isURL(path string) bool {
+	s := urlScheme(path)
+	_, ok := schemes[s]
+	return ok || s == "http" || s == "https"
+}
+
+// fileFetcher reads file:// URLs, which hold absolute paths.
+type fileFetcher struct{}
+
+func (fileFetcher) Fetch(dir, path string) ([]byte, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	if u.Opaque != "" {
+		return nil, fmt.Errorf("file URLs must have an absolute path")
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file URLs with a host other than localhost are not supported")
+	}
+	p := u.Path
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		// file:///C:/dir/file on Windows.
+		p = p[1:]
+	}
+	return ioutil.ReadFile(filepath.FromSlash(p))
+}
+
+// dataFetcher returns the content of data: URLs, as in RFC 2397, such as
+// data:,Hello%2C%20World or data:text/plain;base64,SGVsbG8=.
+type dataFetcher struct{}
+
+func (dataFetcher) Fetch(dir, path string) ([]byte, error) {
+	header, data, ok := strings.Cut(path[len("data:"):], ",")
+	if !ok {
+		return nil, fmt.Errorf("missing comma in data URL")
+	}
+	if strings.HasSuffix(strings.ToLower(header), ";base64") {
+		data, err := url.PathUnescape(data)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(data)
+	}
+	s, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// schemeFetcher fetches the URLs with the given schemes with their Fetchers,
+// and everything else with Fetcher.
+type schemeFetcher struct {
+	Fetcher
+	schemes map[string]Fetcher
+}
+
+func (s schemeFetcher) Fetch(dir, path string) ([]byte, error) {
+	if f, ok := s.schemes[urlScheme(path)]; ok {
+		return f.Fetch(dir, path)
+	}
+	return s.Fetcher.Fetch(dir, path)
+}
+
+// CachingFetcher returns a Fetcher fetching each file or URL only once with the
+// given Fetcher, or the default one if nil, and returning the same content, or
+// error, every time after that. Files are identified by their path, resolved
+// from the base directory, so documents in different directories share them.
+// It can be used concurrently, and by the calls to Process of several files.
+func CachingFetcher(f Fetcher) Fetcher {
+	if f == nil {
+		f = fetcher{}
+	}
+	return &cachingFetcher{Fetcher: f, results: make(map[string]*fetchResult)}
+}
+
+type cachingFetcher struct {
+	Fetcher
+	mu      sync.Mutex
+	results map[string]*fetchResult
+}
+
+func (c *cachingFetcher) Fetch(dir, path string) ([]byte, error) {
+	key := path
+	if !isURL(path) {
+		key = filepath.Join(dir, filepath.FromSlash(path))
+		if abs, err := filepath.Abs(key); err == nil {
+			key = abs
+		}
+	}
+
+	c.mu.Lock()
+	r, ok := c.results[key]
+	if !ok {
+		r = &fetchResult{done: make(chan struct{})}
+		c.results[key] = r
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		r.b, r.err = c.Fetcher.Fetch(dir, path)
+		close(r.done)
+	}
+	return r.content()
+}
+
+// maxPrefetches is the maximum number of concurrent fetches when prefetching
+// the content of a document.
+const maxPrefetches = 8
+
+// prefetcher returns the content fetched in advance for a document, waiting for
+// it if needed, and uses Fetcher for anything else.
+type prefetcher struct {
+	Fetcher
+	results map[[2]string]*fetchResult
+}
+
+// fetchResult is the result of a fetch, which is available once done is
+// closed.
+type fetchResult struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+func (r *fetchResult) content() ([]byte, error) {
+	<-r.done
+	// the content is copied, as several commands might be modifying it.
+	return append([]byte(nil), r.b...), r.err
+}
+
+func (p *prefetcher) Fetch(dir, path string) ([]byte, error) {
+	r, ok := p.results[[2]string{dir, path}]
+	if !ok {
+		return p.Fetcher.Fetch(dir, path)
+	}
+	return r.content()
+}
+
+// prefetch starts fetching the content of all the commands in the document
+// concurrently, so running them doesn't wait for each fetch in turn. Errors
+// are returned when the command is run, so they're reported in order.
+func (e *embedder) prefetch(d *Document) {
+	p := &prefetcher{Fetcher: e.Fetcher, results: make(map[[2]string]*fetchResult)}
+	sem := make(chan struct{}, maxPrefetches)
+	for _, n := range d.Nodes {
+		emb, ok := n.(*Embed)
+		if !ok {
+			continue
+		}
+		dir, path, err := e.resolveMount(emb.Command.Path)
+		if err != nil {
+			continue
+		}
+		key := [2]string{dir, path}
+		if _, ok := p.results[key]; ok {
+			continue
+		}
+		r := &fetchResult{done: make(chan struct{})}
+		p.results[key] = r
+		go func() {
+			sem <- struct{}{}
+			r.b, r.err = p.Fetcher.Fetch(key[0], key[1])
+			<-sem
+			close(r.done)
+		}()
 	}
-	return ioutil.ReadAll(res.Body)
+	e.Fetcher = p
 }
@@ -0,0 +1,378 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFetcher counts the fetches of each path, resolved from its dir.
+type countingFetcher struct {
+	Fetcher
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *countingFetcher) Fetch(dir, path string) ([]byte, error) {
+	c.mu.Lock()
+	c.counts[filepath.Join(dir, path)]++
+	c.mu.Unlock()
+	return c.Fetcher.Fetch(dir, path)
+}
+
+func TestCachingFetcher(t *testing.T) {
+	counter := &countingFetcher{
+		Fetcher: mixedContentProvider{
+			files: map[string][]byte{"docs/code.go": []byte(content)},
+			urls:  map[string][]byte{"https://fakeurl.com/main.go": []byte(content)},
+		},
+		counts: map[string]int{},
+	}
+	f := CachingFetcher(counter)
+
+	var wg sync.WaitGroup
+	for _, p := range [][2]string{
+		{"docs", "code.go"},
+		{".", "docs/code.go"},
+		{"docs/guides", "../code.go"},
+		{"docs", "https://fakeurl.com/main.go"},
+		{"other", "https://fakeurl.com/main.go"},
+		{"docs", "missing.go"},
+	} {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f.Fetch(p[0], p[1])
+			}()
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, 3, len(counter.counts))
+	for path, n := range counter.counts {
+		assert.Equal(t, 1, n, path)
+	}
+
+	_, err := f.Fetch("docs", "missing.go")
+	assert.EqualError(t, err, "file does not exist")
+
+	b, err := f.Fetch("docs", "code.go")
+	assert.NoError(t, err)
+	b[1] = 'X'
+	b, err = f.Fetch("docs", "code.go")
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(b))
+}
+
+func TestProcessWithCachingFetcher(t *testing.T) {
+	counter := &countingFetcher{
+		Fetcher: fakeFileProvider{"code.go": []byte(content)},
+		counts:  map[string]int{},
+	}
+	opts := WithFetcher(CachingFetcher(counter))
+	in := "[embedmd]:# (code.go /package/)\n[embedmd]:# (code.go)\n"
+	for i := 0; i < 3; i++ {
+		var out bytes.Buffer
+		assert.NoError(t, Process(&out, strings.NewReader(in), nil, opts))
+		assert.Contains(t, out.String(), "```go\npackage\n```\n")
+	}
+	assert.Equal(t, map[string]int{"code.go": 1}, counter.counts)
+}
+
+func TestFetchURL(t *testing.T) {
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "finally")
+	})
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 17))
+	})
+	mux.HandleFunc("/streamed", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 17; i++ {
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	t.Setenv("DOCS_TOKEN", "secret")
+	f := NewFetcher(HTTPOptions{
+		Timeout: 100 * time.Millisecond,
+		Retries: 2,
+		Backoff: time.Millisecond,
+		MaxSize: 16,
+		Headers: map[string]map[string]string{
+			strings.TrimPrefix(s.URL, "http://"): {"Authorization": "Bearer ${DOCS_TOKEN}"},
+		},
+	})
+
+	tc := []struct {
+		path     string
+		out      string
+		err      string
+		requests int32
+	}{
+		{path: "/ok", out: "hello"},
+		{path: "/flaky", out: "finally", requests: 3},
+		{path: "/down", err: "status 503 Service Unavailable", requests: 3},
+		{path: "/missing", err: "status 404 Not Found", requests: 1},
+		{path: "/slow", err: "context deadline exceeded", requests: 3},
+		{path: "/big", err: "content is larger than 16 bytes"},
+		{path: "/streamed", err: "content is larger than 16 bytes"},
+		{path: "/auth", out: "Bearer secret"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.path, func(t *testing.T) {
+			requests.Store(0)
+			b, err := f.Fetch("", s.URL+tt.path)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.err)
+			}
+			assert.Equal(t, tt.out, string(b))
+			if tt.requests > 0 {
+				assert.Equal(t, tt.requests, requests.Load())
+			}
+		})
+	}
+}
+
+func TestFetchURLWithoutRetries(t *testing.T) {
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	_, err := NewFetcher(HTTPOptions{Retries: -1}).Fetch("", s.URL)
+	assert.EqualError(t, err, "status 500 Internal Server Error")
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestGitHubToken(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "ghp_secret")
+	tc := []struct {
+		url     string
+		headers map[string]map[string]string
+		auth    string
+	}{
+		{url: "https://raw.githubusercontent.com/grafana/embedmd/main/go.mod", auth: "token ghp_secret"},
+		{url: "https://example.com/go.mod", auth: ""},
+		{url: "http://raw.githubusercontent.com/grafana/embedmd/main/go.mod", auth: ""},
+		{url: "https://raw.githubusercontent.com/grafana/embedmd/main/go.mod",
+			headers: map[string]map[string]string{"raw.githubusercontent.com": {"Authorization": "Bearer other"}},
+			auth:    "Bearer other"},
+	}
+
+	for _, tt := range tc {
+		req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+		assert.NoError(t, err)
+		HTTPOptions{Headers: tt.headers}.addHeaders(req)
+		assert.Equal(t, tt.auth, req.Header.Get("Authorization"), tt.url)
+	}
+}
+
+func TestFetchURLWithCache(t *testing.T) {
+	var modified, notModified atomic.Int32
+	version := "v1"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/etag", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"`+version+`"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		modified.Add(1)
+		w.Header().Set("ETag", `"`+version+`"`)
+		fmt.Fprint(w, version)
+	})
+	mux.HandleFunc("/modified", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == "Fri, 16 Oct 2026 10:00:00 GMT" {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		modified.Add(1)
+		w.Header().Set("Last-Modified", "Fri, 16 Oct 2026 10:00:00 GMT")
+		fmt.Fprint(w, "modified")
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	dir := t.TempDir()
+	f := NewFetcher(HTTPOptions{CacheDir: dir})
+	fetch := func(path, want string) {
+		t.Helper()
+		b, err := f.Fetch("", s.URL+path)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(b))
+	}
+
+	fetch("/etag", "v1")
+	fetch("/etag", "v1")
+	fetch("/modified", "modified")
+	fetch("/modified", "modified")
+	assert.Equal(t, int32(2), modified.Load())
+	assert.Equal(t, int32(2), notModified.Load())
+
+	version = "v2"
+	fetch("/etag", "v2")
+	assert.Equal(t, int32(3), modified.Load())
+
+	// offline, the content is read from the cache, without any requests.
+	s.Close()
+	f = NewFetcher(HTTPOptions{CacheDir: dir, Offline: true})
+	fetch("/etag", "v2")
+	fetch("/modified", "modified")
+	_, err := f.Fetch("", s.URL+"/missing")
+	assert.EqualError(t, err, s.URL+"/missing is not in the cache in "+dir+", and can't be fetched offline")
+}
+
+func TestFetchAuthenticatedURLWithCache(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	headers := map[string]map[string]string{u.Host: {"Authorization": "Bearer secret"}}
+
+	dir := t.TempDir()
+	b, err := NewFetcher(HTTPOptions{CacheDir: dir, Headers: headers}).Fetch("", s.URL+"/private")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer secret", string(b))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "authenticated responses shouldn't be cached by default")
+
+	_, err = NewFetcher(HTTPOptions{CacheDir: dir, Headers: headers, Offline: true}).Fetch("", s.URL+"/private")
+	assert.EqualError(t, err, s.URL+"/private is fetched with credentials, so it's not cached without cacheAuthenticated, and can't be fetched offline")
+
+	_, err = NewFetcher(HTTPOptions{CacheDir: dir, Headers: headers, CacheAuthenticated: true}).Fetch("", s.URL+"/private")
+	assert.NoError(t, err)
+	fi, err := os.Stat(cacheFile(dir, s.URL+"/private"))
+	if assert.NoError(t, err) && runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+}
+
+func TestURLScheme(t *testing.T) {
+	tc := map[string]string{
+		"https://example.com/a.go": "https",
+		"HTTP://example.com/a.go":  "http",
+		"data:,hello":              "data",
+		"git+ssh://host/repo":      "git+ssh",
+		"file:///tmp/a.go":         "file",
+		"code.go":                  "",
+		"docs/a:b.go":              "",
+		`C:\docs\code.go`:          "",
+		"1a://host":                "",
+	}
+	for path, want := range tc {
+		assert.Equal(t, want, urlScheme(path), path)
+	}
+}
+
+func TestFetchSchemes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "code.go")
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0644))
+
+	tc := []struct {
+		path string
+		out  string
+		err  string
+	}{
+		{path: "file://" + filepath.ToSlash(file), out: content},
+		{path: "file://localhost" + filepath.ToSlash(file), out: content},
+		{path: "file://host/code.go", err: "file URLs with a host other than localhost are not supported"},
+		{path: "file:code.go", err: "file URLs must have an absolute path"},
+		{path: "data:,Hello%2C%20World", out: "Hello, World"},
+		{path: "data:text/plain;charset=utf-8,a%0Ab", out: "a\nb"},
+		{path: "data:text/plain;base64,SGVsbG8=", out: "Hello"},
+		{path: "data:;base64,%%%", err: `invalid URL escape "%%%"`},
+		{path: "data:hello", err: "missing comma in data URL"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.path, func(t *testing.T) {
+			b, err := fetcher{}.Fetch("", tt.path)
+			if !eqErr(t, tt.path, err, tt.err) {
+				return
+			}
+			assert.Equal(t, tt.out, string(b))
+		})
+	}
+}
+
+func TestWithScheme(t *testing.T) {
+	git := mixedContentProvider{urls: map[string][]byte{"git://host/repo/main.go": []byte(content)}}
+	in := "[embedmd]:# (git://host/repo/main.go /package/)\n[embedmd]:# (data:,hello lang:text)\n"
+	var out bytes.Buffer
+	err := Process(&out, strings.NewReader(in), nil, WithScheme("GIT", schemeFunc(
+		func(dir, path string) ([]byte, error) {
+			return git.urls[path], nil
+		})))
+	assert.NoError(t, err)
+	assert.Equal(t, "[embedmd]:# (git://host/repo/main.go /package/)\n```go\npackage\n```\n"+
+		"[embedmd]:# (data:,hello lang:text)\n```text\nhello\n```\n", out.String())
+}
+
+type schemeFunc func(dir, path string) ([]byte, error)
+
+func (f schemeFunc) Fetch(dir, path string) ([]byte, error) { return f(dir, path) }
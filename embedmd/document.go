@@ -0,0 +1,269 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A Document is a markdown document split in the parts that are relevant to
+// embedmd. Documents are obtained with Parse and written back with Render.
+//
+// CRLF is set for documents whose lines end in \r\n, and NoFinalNewline for
+// documents whose last line has no line ending. Render keeps both, also for the
+// embedded content.
+type Document struct {
+	Nodes          []Node
+	CRLF           bool
+	NoFinalNewline bool
+}
+
+// A Node is a part of a Document: *Text, *CodeBlock, *Embed or *FrontMatter.
+type Node interface {
+	// Pos returns the line where the node starts, the first line being 1.
+	Pos() int
+}
+
+// Text is a sequence of lines of markdown with no embedmd commands or code.
+type Text struct {
+	Line  int
+	Lines []string
+}
+
+// A CodeBlock is a code section of the document, delimited by fences of
+// backticks or tildes.
+type CodeBlock struct {
+	Line  int
+	Open  string   // opening fence, such as ```go
+	Lines []string // content, without the fences
+	Close string   // closing fence, empty if the blockquote or list item ends first
+}
+
+// An Embed is an embedmd command. Output holds the lines written the last time
+// the command was run, which are replaced when the document is rendered.
+//
+// Commands are written in a single line, in Directive, or in YAML either in the
+// front matter of the document or in an embedmd code section, which is a
+// separate node in the document preceding the embeds it holds.
+//
+// Prefix holds the indentation or blockquote markers of a directive in a list
+// or a blockquote, which are written before every line of the output too.
+//
+// When Command is changed, Render writes the directive again from it, after
+// Prefix. Commands in YAML are not written again: the lines of the front matter
+// or of the code section holding them must be changed too.
+type Embed struct {
+	Line        int
+	Directive   string
+	Prefix      string
+	FrontMatter *FrontMatter
+	Block       *CodeBlock
+	Command     *Command
+	Output      []string
+}
+
+// FrontMatter is the front matter holding the commands of a document in YAML
+// mode. Lines are the lines between the delimiters, which are --- for YAML and
+// +++ for TOML. JSON front matter has no delimiters, so its lines include the
+// braces of the object.
+//
+// The output of the commands is written after every [embedmd-yaml]:#
+// placeholder in the body of the document. Without placeholders, the output
+// replaces the whole body and ReplaceBody is set. Lines are written as they
+// are, so they must be changed along with Commands.
+type FrontMatter struct {
+	Line        int
+	Delimiter   string
+	Lines       []string
+	Commands    []*Command
+	ReplaceBody bool
+}
+
+func (t *Text) Pos() int        { return t.Line }
+func (c *CodeBlock) Pos() int   { return c.Line }
+func (e *Embed) Pos() int       { return e.Line }
+func (f *FrontMatter) Pos() int { return f.Line }
+
+// frontMatter returns the front matter of the document, if any.
+func (d *Document) frontMatter() *FrontMatter {
+	if len(d.Nodes) == 0 {
+		return nil
+	}
+	f, _ := d.Nodes[0].(*FrontMatter)
+	return f
+}
+
+func (d *Document) addText(line int, s string) {
+	if n := len(d.Nodes); n > 0 {
+		if t, ok := d.Nodes[n-1].(*Text); ok {
+			t.Lines = append(t.Lines, s)
+			return
+		}
+	}
+	d.Nodes = append(d.Nodes, &Text{Line: line, Lines: []string{s}})
+}
+
+// Info returns the info string of the code block, such as the language.
+func (c *CodeBlock) Info() string {
+	_, info, _ := parseFence(c.Open)
+	return info
+}
+
+// Render writes the given document into out, running all of its embedmd
+// commands and replacing their previous output. The options are the same as
+// the ones used by Process.
+//
+// The content of all the commands is fetched concurrently before running them.
+func Render(out io.Writer, d *Document, mounts map[string]string, opts ...Option) error {
+	e := newEmbedder(mounts, opts)
+	e.prefetch(d)
+	return render(out, d, e.runCommand)
+}
+
+func render(out io.Writer, d *Document, run commandRunner) error {
+	var b bytes.Buffer
+	if err := renderNodes(&b, d, run); err != nil {
+		return err
+	}
+
+	// nodes are rendered with \n line endings, but embedded content might
+	// come with its own.
+	text := bytes.ReplaceAll(b.Bytes(), []byte("\r\n"), []byte("\n"))
+	if d.NoFinalNewline {
+		text = bytes.TrimSuffix(text, []byte("\n"))
+	}
+	if d.CRLF {
+		text = bytes.ReplaceAll(text, []byte("\n"), []byte("\r\n"))
+	}
+	_, err := out.Write(text)
+	return err
+}
+
+func renderNodes(out io.Writer, d *Document, run commandRunner) error {
+	for _, n := range d.Nodes {
+		switch n := n.(type) {
+		case *Text:
+			writeLines(out, n.Lines...)
+		case *CodeBlock:
+			writeLines(out, n.Open)
+			writeLines(out, n.Lines...)
+			if n.Close != "" {
+				writeLines(out, n.Close)
+			}
+		case *FrontMatter:
+			if n.Delimiter != "" {
+				writeLines(out, n.Delimiter)
+			}
+			writeLines(out, n.Lines...)
+			if n.Delimiter != "" {
+				writeLines(out, n.Delimiter)
+			}
+		case *Embed:
+			if err := renderEmbed(out, n, run); err != nil {
+				return fmt.Errorf("%d: %v", n.Line, err)
+			}
+		default:
+			return fmt.Errorf("%d: unknown node type %T", n.Pos(), n)
+		}
+	}
+	return nil
+}
+
+func renderEmbed(out io.Writer, e *Embed, run commandRunner) error {
+	if e.FrontMatter != nil && e.FrontMatter.ReplaceBody {
+		fmt.Fprintln(out)
+		return run(out, e.Command)
+	}
+
+	directive := e.directive()
+	if directive != "" {
+		writeLines(out, directive)
+	}
+	if e.Prefix != "" {
+		out = &prefixWriter{w: out, prefix: e.Prefix}
+	}
+	if e.Command.Type != typePlain {
+		return run(out, e.Command)
+	}
+
+	var b bytes.Buffer
+	if err := run(&b, e.Command); err != nil {
+		return err
+	}
+	if b.Len() > 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	b.WriteTo(out)
+	if strings.HasPrefix(directive[len(e.Prefix):], htmlPrefix) {
+		writeLines(out, htmlEndMarker)
+	} else {
+		writeLines(out, plainEndMarker)
+	}
+	return nil
+}
+
+// directive returns the directive of the embed, written again from its command
+// if the command was changed since it was parsed, in the same form if possible.
+func (e *Embed) directive() string {
+	if e.Directive == "" {
+		return ""
+	}
+	line, want := e.Directive[len(e.Prefix):], e.Command.inline()
+	if roundTrips(line, want) {
+		return e.Directive
+	}
+	if s := want.htmlString(); strings.HasPrefix(line, htmlPrefix) && roundTrips(s, want) {
+		return e.Prefix + s
+	}
+	return e.Prefix + e.Command.String()
+}
+
+func writeLines(out io.Writer, lines ...string) {
+	for _, l := range lines {
+		fmt.Fprintln(out, l)
+	}
+}
+
+// prefixWriter writes the given prefix at the start of every line, without its
+// trailing blanks on empty lines.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	inLine bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !p.inLine {
+			prefix := p.prefix
+			if line[0] == '\n' {
+				prefix = strings.TrimRight(prefix, " \t")
+			}
+			if _, err := io.WriteString(p.w, prefix); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := p.w.Write(line); err != nil {
+			return 0, err
+		}
+		p.inLine = line[len(line)-1] != '\n'
+	}
+	return len(b), nil
+}
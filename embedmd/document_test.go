@@ -0,0 +1,202 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	const in = "# Title\n" +
+		"[embedmd]:# (code.go /func/ $)\n" +
+		"```go\n" +
+		"old\n" +
+		"```\n" +
+		"text\n" +
+		"```sh\n" +
+		"ls\n" +
+		"```\n" +
+		"[embedmd]:# (code.go noCode)\n" +
+		"old\n" +
+		"[embedmd-end]:#\n"
+
+	d, err := Parse(strings.NewReader(in))
+	assert.NoError(t, err)
+	assert.Equal(t, []Node{
+		&Text{Line: 1, Lines: []string{"# Title"}},
+		&Embed{
+			Line:      2,
+			Directive: "[embedmd]:# (code.go /func/ $)",
+			Command:   &Command{Path: "code.go", Type: typeCode, Start: ptr("/func/"), End: ptr("$"), IncludeStart: true, IncludeEnd: true},
+			Output:    []string{"```go", "old", "```"},
+		},
+		&Text{Line: 6, Lines: []string{"text"}},
+		&CodeBlock{Line: 7, Open: "```sh", Lines: []string{"ls"}, Close: "```"},
+		&Embed{
+			Line:      10,
+			Directive: "[embedmd]:# (code.go noCode)",
+			Command:   &Command{Path: "code.go", Type: typePlain, IncludeStart: true, IncludeEnd: true},
+			Output:    []string{"old", "[embedmd-end]:#"},
+		},
+	}, d.Nodes)
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	d, err := Parse(strings.NewReader("---\nembed:\n  src: code.go\n---\n\nold\n"))
+	assert.NoError(t, err)
+	cmd := &Command{Path: "code.go", Type: typeCode, IncludeStart: true, IncludeEnd: true, yamlMode: true}
+	fm := &FrontMatter{Line: 1, Lines: []string{"embed:", "  src: code.go"}, Delimiter: "---", Commands: []*Command{cmd}, ReplaceBody: true}
+	assert.Equal(t, []Node{
+		fm,
+		&Embed{
+			Line:        3,
+			FrontMatter: fm,
+			Command:     cmd,
+			Output:      []string{"", "old"},
+		},
+	}, d.Nodes)
+}
+
+func TestParseFrontMatterWithPlaceholder(t *testing.T) {
+	d, err := Parse(strings.NewReader("---\nembed:\n  src: code.go\n---\ntext\n[embedmd-yaml]:#\n```go\nold\n```\nmore text\n"))
+	assert.NoError(t, err)
+	cmd := &Command{Path: "code.go", Type: typeCode, IncludeStart: true, IncludeEnd: true, yamlMode: true}
+	fm := &FrontMatter{Line: 1, Lines: []string{"embed:", "  src: code.go"}, Delimiter: "---", Commands: []*Command{cmd}}
+	assert.Equal(t, []Node{
+		fm,
+		&Text{Line: 5, Lines: []string{"text", "[embedmd-yaml]:#"}},
+		&Embed{
+			Line:        6,
+			FrontMatter: fm,
+			Command:     cmd,
+			Output:      []string{"```go", "old", "```"},
+		},
+		&Text{Line: 10, Lines: []string{"more text"}},
+	}, d.Nodes)
+}
+
+func TestParseFrontMatterWithoutEmbed(t *testing.T) {
+	d, err := Parse(strings.NewReader("---\ntitle: hello\n---\n[embedmd]:# (code.go)\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Node{
+		&Text{Line: 1, Lines: []string{"---", "title: hello", "---"}},
+		&Embed{
+			Line:      4,
+			Directive: "[embedmd]:# (code.go)",
+			Command:   &Command{Path: "code.go", Type: typeCode, IncludeStart: true, IncludeEnd: true},
+		},
+	}, d.Nodes)
+}
+
+func TestParseYAMLBlock(t *testing.T) {
+	const in = "text\n" +
+		"```embedmd\n" +
+		"- src: code.go\n" +
+		"  type: plain\n" +
+		"- src: other.go\n" +
+		"```\n" +
+		"old plain\n" +
+		"[embedmd-end]:#\n" +
+		"```go\n" +
+		"old code\n" +
+		"```\n" +
+		"text\n"
+
+	d, err := Parse(strings.NewReader(in))
+	assert.NoError(t, err)
+	block := &CodeBlock{Line: 2, Open: "```embedmd", Lines: []string{"- src: code.go", "  type: plain", "- src: other.go"}, Close: "```"}
+	assert.Equal(t, []Node{
+		&Text{Line: 1, Lines: []string{"text"}},
+		block,
+		&Embed{
+			Line:    3,
+			Block:   block,
+			Command: &Command{Path: "code.go", Type: typePlain, IncludeStart: true, IncludeEnd: true, yamlMode: true},
+			Output:  []string{"old plain", "[embedmd-end]:#"},
+		},
+		&Embed{
+			Line:    5,
+			Block:   block,
+			Command: &Command{Path: "other.go", Type: typeCode, IncludeStart: true, IncludeEnd: true, yamlMode: true},
+			Output:  []string{"```go", "old code", "```"},
+		},
+		&Text{Line: 12, Lines: []string{"text"}},
+	}, d.Nodes)
+}
+
+func TestRender(t *testing.T) {
+	const in = "# Title\n" +
+		"[embedmd]:# (code.go)\n" +
+		"```go\n" +
+		"old\n" +
+		"```\n" +
+		"```sh\n" +
+		"ls\n" +
+		"```\n"
+
+	d, err := Parse(strings.NewReader(in))
+	assert.NoError(t, err)
+	d.Nodes[1].(*Embed).Command.Lines = "2"
+
+	var out bytes.Buffer
+	err = Render(&out, d, nil, WithFetcher(fakeFileProvider{"code.go": []byte(content)}))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Title\n"+
+		"[embedmd]:# (code.go L2)\n"+
+		"```go\n"+
+		"package main\n"+
+		"```\n"+
+		"```sh\n"+
+		"ls\n"+
+		"```\n", out.String())
+}
+
+func TestRenderChangedDirective(t *testing.T) {
+	tc := []struct {
+		name, in, out string
+		change        func(*Command)
+	}{
+		{name: "unchanged directives are kept",
+			in:     "[embedmd]:#  (code.go   L2)\n",
+			out:    "[embedmd]:#  (code.go   L2)\n```go\npackage main\n```\n",
+			change: func(*Command) {}},
+		{name: "in a list",
+			in:     "1. Step\n\n   [embedmd]:# (code.go)\n",
+			out:    "1. Step\n\n   [embedmd]:# (code.go L2)\n   ```go\n   package main\n   ```\n",
+			change: func(c *Command) { c.Lines = "2" }},
+		{name: "html comment",
+			in:     "<!-- embedmd src=code.go noCode -->\n\n",
+			out:    "<!-- embedmd src=code.go noCode lines=2 -->\npackage main\n<!-- embedmd-end -->\n\n",
+			change: func(c *Command) { c.Lines = "2" }},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Parse(strings.NewReader(tt.in))
+			assert.NoError(t, err)
+			for _, n := range d.Nodes {
+				if e, ok := n.(*Embed); ok {
+					tt.change(e.Command)
+				}
+			}
+
+			var out bytes.Buffer
+			assert.NoError(t, Render(&out, d, nil, WithFetcher(fakeFileProvider{"code.go": []byte(content)})))
+			assert.Equal(t, tt.out, out.String())
+		})
+	}
+}
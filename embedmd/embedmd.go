@@ -12,7 +12,8 @@
 // limitations under the License.
 
 // Package embedmd provides a single function, Process, that parses markdown
-// searching for markdown comments.
+// searching for markdown comments. Parse and Render provide the two halves of
+// Process, so documents can be inspected or modified before being rendered.
 //
 // The format of an embedmd command is:
 //
@@ -23,6 +24,8 @@
 // system (using always forward slashes as directory separator) or
 // a url starting with http:// or https://.
 // If the pathOrURL is a url the tool will fetch the content in that url.
+// file:// urls and data: urls, such as data:,Hello%20World, are supported
+// too, and other schemes can be added with WithScheme.
 // The embedded content starts at the first line that matches /start regexp/
 // and finishes at the first line matching /end regexp/.
 //
@@ -39,16 +42,58 @@
 //
 //	[embedmd]:# (pathOrURL language /start regexp/ $)
 //
+// Instead of regular expressions you can select lines by number. Line ranges
+// are 1-based and inclusive, can be open-ended, and can be repeated to embed
+// several ranges one after the other:
+//
+//	[embedmd]:# (pathOrURL language L12-L20)
+//	[embedmd]:# (pathOrURL language L12-)
+//	[embedmd]:# (pathOrURL language L1-L3 L10-L12)
+//
+// Go declarations can be selected by name, in which case the file is parsed
+// and the whole declaration, including its doc comment, is embedded:
+//
+//	[embedmd]:# (pathOrURL go:func main)
+//	[embedmd]:# (pathOrURL go:type Fetcher)
+//	[embedmd]:# (pathOrURL go:method embedder.runCommand)
+//
+// Named regions delimited by "[START name]" and "[END name]" markers, usually
+// in comments, can be embedded without the marker lines:
+//
+//	[embedmd]:# (pathOrURL region:snippet_name)
+//
 // Finally you can embed a whole file by omitting both regular expressions:
 //
 //	[embedmd]:# (pathOrURL language)
 //
-// You can omit the language in any of the previous commands, and the extension
-// of the file will be used for the snippet syntax highlighting. Note that while
-// this works Go files, since the file extension .go matches the name of the language
-// go, this will fail with other files like .md whose language name is markdown.
+// You can omit the language in any of the previous commands, and it will be
+// inferred from the name of the file, such as markdown for .md files or
+// dockerfile for Dockerfile, or from the shebang line of files with no
+// extension. Unknown extensions are used as the language, and WithLanguages
+// adds or overrides mappings.
 //
 //	[embedmd]:# (file.ext)
+//
+// Commands can be indented or in blockquotes, and their output is written with
+// the same indentation or blockquote markers. Commands indented by four or more
+// spaces outside of a list are indented code, and are left alone.
+//
+// Commands can also be written as HTML comments, which no markdown renderer
+// displays. Arguments are flags or key=value pairs using the same names as the
+// YAML mode, and values can be double quoted to contain blanks or newlines:
+//
+//	<!-- embedmd src=pathOrURL lang=go start="/func main() {/" end=$ -->
+//
+// Commands can be written in YAML too, either under the embed key of the front
+// matter of the document or in a code section with embedmd as its language.
+// TOML and JSON front matter are supported as well, with the same keys.
+// In both cases a list of commands can be given instead of a single one.
+// The output of front matter commands replaces the body of the document unless
+// the body has [embedmd-yaml]:# placeholder lines, which are followed by it.
+//
+// Project wide mounts, languages and templates can be declared in a Config,
+// usually read from a .embedmd.yaml file with FindConfig, and used with
+// WithConfig.
 package embedmd
 
 import (
@@ -56,7 +101,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -65,11 +113,13 @@ import (
 // command. When a command is found, it is executed and the output is written
 // into the given io.Writer with the rest of standard markdown.
 func Process(out io.Writer, in io.Reader, mounts map[string]string, opts ...Option) error {
-	e := embedder{Fetcher: fetcher{}, mounts: mounts}
-	for _, opt := range opts {
-		opt.f(&e)
+	e := newEmbedder(mounts, opts)
+	d, err := parseDocument(in, e.legacyPlain)
+	if err != nil {
+		return err
 	}
-	return process(out, in, e.runCommand)
+	e.prefetch(d)
+	return render(out, d, e.runCommand)
 }
 
 // An Option provides a way to adapt the Process function to your needs.
@@ -81,32 +131,114 @@ func WithBaseDir(path string) Option {
 	return Option{func(e *embedder) { e.baseDir = path }}
 }
 
+// WithLegacyPlainOutput makes Process take the output of plain commands that
+// isn't followed by an end marker, as written by versions of embedmd before end
+// markers were added, up to the next blank line, so those documents can be
+// processed once to add the markers. The lines of that output after a blank one
+// can't be told apart from the text following it, so they are kept as text.
+func WithLegacyPlainOutput() Option {
+	return Option{func(e *embedder) { e.legacyPlain = true }}
+}
+
 // WithFetcher provides a custom Fetcher to be used whenever a path or url needs
-// to be fetched.
+// to be fetched. It must be safe for concurrent use.
 func WithFetcher(c Fetcher) Option {
 	return Option{func(e *embedder) { e.Fetcher = c }}
 }
 
+// WithScheme provides a Fetcher for the paths that are URLs with the given
+// scheme, such as "git" for git://host/repo, instead of the one given with
+// WithFetcher. Besides http and https, the default Fetcher supports the file
+// and data schemes. The given Fetcher is called directly, bypassing the one
+// given with WithFetcher, so the content of these URLs is neither shared by
+// CachingFetcher nor verified by LockingFetcher.
+func WithScheme(scheme string, f Fetcher) Option {
+	return Option{func(e *embedder) {
+		if e.schemes == nil {
+			e.schemes = make(map[string]Fetcher)
+		}
+		e.schemes[strings.ToLower(scheme)] = f
+	}}
+}
+
 type embedder struct {
 	Fetcher
-	baseDir string
-	mounts  map[string]string
+	schemes      map[string]Fetcher
+	legacyPlain  bool
+	baseDir      string
+	mounts       map[string]string
+	configMounts map[string]string
+	languages    map[string]string
+	templates    map[string]string
+}
+
+func newEmbedder(mounts map[string]string, opts []Option) *embedder {
+	e := &embedder{Fetcher: fetcher{}, mounts: mounts}
+	for _, opt := range opts {
+		opt.f(e)
+	}
+	if len(e.schemes) > 0 {
+		e.Fetcher = schemeFetcher{Fetcher: e.Fetcher, schemes: e.schemes}
+	}
+	if len(e.configMounts) > 0 {
+		e.mounts = make(map[string]string)
+		for k, v := range e.configMounts {
+			e.mounts[k] = v
+		}
+		for k, v := range mounts {
+			e.mounts[k] = v
+		}
+	}
+	return e
 }
 
 type templateArgs struct {
 	Content string
 }
 
-func (e *embedder) runCommand(w io.Writer, cmd *command) error {
-	path := cmd.Path
-	for k, v := range e.mounts {
-		path = strings.ReplaceAll(path, k, v)
+// resolveMount replaces the mount point at the start of the given path, as in
+// $name/file.go, by its target. Mount names can contain slashes, in which case
+// the longest one matching whole path elements is used. It also returns the
+// directory the path is relative to, which is the base directory except for
+// mounts of absolute paths, as paths in documents are always relative to it.
+func (e *embedder) resolveMount(path string) (dir, resolved string, err error) {
+	if !strings.HasPrefix(path, "$") {
+		return e.baseDir, path, nil
+	}
+	name := ""
+	for k := range e.mounts {
+		if len(k) > len(name) && (path == k || strings.HasPrefix(path, k+"/")) {
+			name = k
+		}
+	}
+	if name == "" {
+		name, _, _ = strings.Cut(path, "/")
+		return "", "", fmt.Errorf("unknown mount %s", name)
+	}
+	resolved = strings.TrimSuffix(e.mounts[name], "/") + path[len(name):]
+	if !isURL(resolved) && filepath.IsAbs(filepath.FromSlash(resolved)) {
+		return "", resolved, nil
+	}
+	return e.baseDir, resolved, nil
+}
+
+func (e *embedder) runCommand(w io.Writer, cmd *Command) error {
+	dir, path, err := e.resolveMount(cmd.Path)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", cmd.Path, err)
 	}
-	b, err := e.Fetch(e.baseDir, path)
+	b, err := e.Fetch(dir, path)
 	if err != nil {
 		return fmt.Errorf("could not read %s: %v", path, err)
 	}
 
+	lang := cmd.Lang
+	if lang == "" && cmd.Type == typeCode {
+		if lang = e.language(path, b); lang == "" && !cmd.yamlMode {
+			return fmt.Errorf("language is required for %s, as it can't be inferred from its name or content", path)
+		}
+	}
+
 	b, err = extract(b, cmd)
 	if err != nil {
 		return fmt.Errorf("could not extract content from %s: %v", path, err)
@@ -135,14 +267,15 @@ func (e *embedder) runCommand(w io.Writer, cmd *command) error {
 	}
 
 	if cmd.Template != "" {
-		b, err = applyTemplate(b, cmd.Template)
+		b, err = applyTemplate(b, cmd.Template, e.templates)
 		if err != nil {
 			return fmt.Errorf("could not apply template to content from %s: %v", path, err)
 		}
 	}
 
+	fence := codeFence(b)
 	if cmd.Type == typeCode {
-		fmt.Fprintln(w, "```"+cmd.Lang)
+		fmt.Fprintln(w, fence+lang)
 	}
 	w.Write(b)
 
@@ -151,12 +284,57 @@ func (e *embedder) runCommand(w io.Writer, cmd *command) error {
 	}
 
 	if cmd.Type == typeCode {
-		fmt.Fprintln(w, "```")
+		fmt.Fprintln(w, fence)
 	}
 	return nil
 }
 
-func extract(b []byte, c *command) ([]byte, error) {
+// codeFence returns a fence of backticks longer than any run of backticks in
+// the given content, so the content can't close the code section early.
+func codeFence(b []byte) string {
+	longest := 2
+	for n, i := 0, 0; i < len(b); i++ {
+		if b[i] != '`' {
+			n = 0
+		} else if n++; n > longest {
+			longest = n
+		}
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+func extract(b []byte, c *Command) ([]byte, error) {
+	var selectors []string
+	if c.Lines != "" {
+		selectors = append(selectors, "line ranges")
+	}
+	if c.GoDecl != "" {
+		selectors = append(selectors, "go declarations")
+	}
+	if c.Region != "" {
+		selectors = append(selectors, "regions")
+	}
+	if c.Start != nil || c.End != nil {
+		selectors = append(selectors, "regular expressions")
+	}
+	if len(selectors) > 1 {
+		return nil, fmt.Errorf("%s cannot be combined with %s", selectors[0], selectors[1])
+	}
+
+	if c.Lines != "" {
+		ranges, err := parseLineRanges(c.Lines)
+		if err != nil {
+			return nil, err
+		}
+		return extractLines(b, ranges, c.IncludeStart, c.IncludeEnd)
+	}
+	if c.GoDecl != "" {
+		return extractGoDecl(b, c.GoDecl)
+	}
+	if c.Region != "" {
+		return extractRegion(b, c.Region)
+	}
+
 	if c.Start == nil && c.End == nil {
 		return b, nil
 	}
@@ -180,7 +358,8 @@ func extract(b []byte, c *command) ([]byte, error) {
 		return loc, nil
 	}
 
-	if *c.Start != "" {
+	// without a start, the content is taken from its beginning.
+	if c.Start != nil && *c.Start != "" {
 		loc, err := match(*c.Start)
 		if err != nil {
 			return nil, err
@@ -195,7 +374,7 @@ func extract(b []byte, c *command) ([]byte, error) {
 		b = b[start:]
 	}
 
-	if *c.End != "$" {
+	if c.End != nil && *c.End != "$" {
 		loc, err := match(*c.End)
 		if err != nil {
 			return nil, err
@@ -210,6 +389,104 @@ func extract(b []byte, c *command) ([]byte, error) {
 	return b, nil
 }
 
+// lineRange is a 1-based inclusive range of lines. An end of zero means the
+// range extends to the last line.
+type lineRange struct{ start, end int }
+
+func (r lineRange) String() string {
+	if r.end == 0 {
+		return fmt.Sprintf("%d-", r.start)
+	}
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// parseLineRanges parses a comma separated list of line ranges such as
+// "12-20", "12-" or "7".
+func parseLineRanges(s string) ([]lineRange, error) {
+	var ranges []lineRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(from)
+		if err != nil || start < 1 {
+			return nil, fmt.Errorf("invalid line range %q", part)
+		}
+		r := lineRange{start: start, end: start}
+		if isRange {
+			r.end = 0
+			if to != "" {
+				if r.end, err = strconv.Atoi(to); err != nil || r.end < start {
+					return nil, fmt.Errorf("invalid line range %q", part)
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// extractLines returns the concatenation of the given line ranges. When the
+// start or end of the range should not be included, the first or last line of
+// every range is dropped.
+func extractLines(b []byte, ranges []lineRange, includeStart, includeEnd bool) ([]byte, error) {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	var out []byte
+	for _, r := range ranges {
+		start, end := r.start, r.end
+		if end == 0 {
+			end = len(lines)
+		}
+		if start > len(lines) || end > len(lines) {
+			return nil, fmt.Errorf("line range %s out of bounds, content has %d lines", r, len(lines))
+		}
+		if !includeStart {
+			start++
+		}
+		if !includeEnd {
+			end--
+		}
+		for i := start; i <= end; i++ {
+			out = append(out, lines[i-1]...)
+		}
+	}
+	return out, nil
+}
+
+// regionMarker matches the lines delimiting a named region, such as
+// "// [START snippet_name]" and "// [END snippet_name]".
+var regionMarker = regexp.MustCompile(`\[(START|END) ([^\]\s]+)\]`)
+
+// extractRegion returns the lines between the start and end markers of the
+// named region. A region can be split in several parts, which are concatenated.
+// Marker lines, including those of other regions, are removed.
+func extractRegion(b []byte, name string) ([]byte, error) {
+	var out []byte
+	found, inside := false, false
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if m := regionMarker.FindSubmatch(line); m != nil {
+			if string(m[2]) == name {
+				inside = string(m[1]) == "START"
+				found = found || inside
+			}
+			continue
+		}
+		if inside {
+			out = append(out, line...)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("could not find region %q", name)
+	}
+	if inside {
+		return nil, fmt.Errorf("missing end of region %q", name)
+	}
+	return out, nil
+}
+
 func replace(b []byte, substitutions []Substitution) ([]byte, error) {
 	for _, s := range substitutions {
 		re, err := regexp.Compile(s.Pattern)
@@ -221,8 +498,24 @@ func replace(b []byte, substitutions []Substitution) ([]byte, error) {
 	return b, nil
 }
 
-func applyTemplate(content []byte, templateDef string) ([]byte, error) {
-	t, err := template.New("embedmd").Parse(templateDef)
+// applyTemplate executes the given template, or the named template with the
+// given name, on the content. Named templates can be called from the template.
+func applyTemplate(content []byte, templateDef string, named map[string]string) ([]byte, error) {
+	t := template.New("embedmd")
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := t.New(name).Parse(named[name]); err != nil {
+			return nil, err
+		}
+	}
+	if def, ok := named[templateDef]; ok {
+		templateDef = def
+	}
+	t, err := t.Parse(templateDef)
 	if err != nil {
 		return nil, err
 	}
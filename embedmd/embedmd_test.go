@@ -21,7 +21,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const content = `
@@ -38,6 +40,8 @@ func TestExtract(t *testing.T) {
 	tc := []struct {
 		name           string
 		start, end     *string
+		lines          string
+		goDecl         string
 		noStart, noEnd bool
 		out            string
 		err            string
@@ -65,6 +69,11 @@ func TestExtract(t *testing.T) {
 		{name: "from func to }",
 			start: ptr("/func main/"), end: ptr("/}/"), out: "func main() {\n        fmt.Println(\"hello, test\")\n}"},
 
+		{name: "only the end",
+			end: ptr("/import/"), out: "\npackage main\n\nimport"},
+		{name: "only the end - skip end",
+			end: ptr("/import/"), noEnd: true, out: "\npackage main\n\n"},
+
 		{name: "bad start regexp",
 			start: ptr("/(/"), err: "error parsing regexp: missing closing ): `(`"},
 		{name: "bad regexp",
@@ -74,14 +83,37 @@ func TestExtract(t *testing.T) {
 
 		{name: "start and end of line ^$",
 			start: ptr("/^func main/"), end: ptr("/}$/"), out: "func main() {\n        fmt.Println(\"hello, test\")\n}"},
+
+		{name: "line range",
+			lines: "6-8", out: "func main() {\n        fmt.Println(\"hello, test\")\n}\n"},
+		{name: "single line",
+			lines: "2", out: "package main\n"},
+		{name: "open ended line range",
+			lines: "7-", out: "        fmt.Println(\"hello, test\")\n}\n"},
+		{name: "several line ranges",
+			lines: "2,6-6,8", out: "package main\nfunc main() {\n}\n"},
+		{name: "line range - skip start and end",
+			lines: "6-8", noStart: true, noEnd: true, out: "        fmt.Println(\"hello, test\")\n"},
+		{name: "line range out of bounds",
+			lines: "6-9", err: "line range 6-9 out of bounds, content has 8 lines"},
+		{name: "bad line range",
+			lines: "8-6", err: "invalid line range \"8-6\""},
+		{name: "go declaration",
+			goDecl: "func main", out: "func main() {\n        fmt.Println(\"hello, test\")\n}"},
+		{name: "go declaration and line range",
+			lines: "6-8", goDecl: "func main", err: "line ranges cannot be combined with go declarations"},
+		{name: "line range and regexp",
+			lines: "6-8", start: ptr("/func/"), err: "line ranges cannot be combined with regular expressions"},
 	}
 
 	for _, tt := range tc {
 		t.Run(tt.name, func(t *testing.T) {
 			b, err := extract([]byte(content),
-				&command{
+				&Command{
 					Start:        tt.start,
 					End:          tt.end,
+					Lines:        tt.lines,
+					GoDecl:       tt.goDecl,
 					IncludeStart: !tt.noStart,
 					IncludeEnd:   !tt.noEnd,
 				})
@@ -95,10 +127,65 @@ func TestExtract(t *testing.T) {
 	}
 }
 
+func TestExtractRegion(t *testing.T) {
+	const source = `package main
+
+// [START imports]
+import "fmt"
+// [END imports]
+
+// [START main]
+func main() {
+	// [START print]
+	fmt.Println("hello")
+	// [END print]
+	// [START other]
+	fmt.Println("other")
+// [END main]
+	fmt.Println("bye")
+	// [END other]
+}
+// [START main]
+// more main
+// [END main]
+`
+
+	tc := []struct {
+		name   string
+		region string
+		out    string
+		err    string
+	}{
+		{name: "simple region",
+			region: "imports", out: "import \"fmt\"\n"},
+		{name: "nested and overlapping markers are removed",
+			region: "main", out: "func main() {\n\tfmt.Println(\"hello\")\n\tfmt.Println(\"other\")\n// more main\n"},
+		{name: "overlapping region",
+			region: "other", out: "\tfmt.Println(\"other\")\n\tfmt.Println(\"bye\")\n"},
+		{name: "missing region",
+			region: "potato", err: "could not find region \"potato\""},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := extractRegion([]byte(source), tt.region)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+			assert.Equal(t, tt.out, string(b))
+		})
+	}
+
+	_, err := extractRegion([]byte("// [START a]\nfoo\n"), "a")
+	assert.EqualError(t, err, "missing end of region \"a\"")
+}
+
 func TestExtractFromFile(t *testing.T) {
 	tc := []struct {
 		name    string
-		cmd     command
+		cmd     Command
 		baseDir string
 		files   map[string][]byte
 		out     string
@@ -106,67 +193,91 @@ func TestExtractFromFile(t *testing.T) {
 	}{
 		{
 			name:  "extract the whole file",
-			cmd:   command{Path: "code.go", Lang: "go", Type: typeCode},
+			cmd:   Command{Path: "code.go", Lang: "go", Type: typeCode},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   "```go\n" + string(content) + "```\n",
 		},
 		{
 			name:  "no code",
-			cmd:   command{Path: "code.go", Lang: "go", Type: typePlain},
+			cmd:   Command{Path: "code.go", Lang: "go", Type: typePlain},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   content,
 		},
 		{
 			name:  "trim",
-			cmd:   command{Path: "code.go", Lang: "go", Type: typeCode, Trim: true},
+			cmd:   Command{Path: "code.go", Lang: "go", Type: typeCode, Trim: true},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   "```go\n" + strings.TrimSpace(content) + "\n```\n",
 		},
 		{
 			name:  "trim plain",
-			cmd:   command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true},
+			cmd:   Command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   strings.TrimSpace(content),
 		},
 		{
 			name:  "trim plain with yaml - because files should always end with a newline",
-			cmd:   command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true, yamlMode: true},
+			cmd:   Command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true, yamlMode: true},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   strings.TrimSpace(content) + "\n",
 		},
 		{
 			name:  "strip start",
-			cmd:   command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true, TrimPrefix: "package main"},
+			cmd:   Command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true, TrimPrefix: "package main"},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   strings.TrimSpace(content[13:]),
 		},
 		{
 			name:  "strip end",
-			cmd:   command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true, TrimSuffix: "}"},
+			cmd:   Command{Path: "code.go", Lang: "go", Type: typePlain, Trim: true, TrimSuffix: "}"},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   strings.TrimSpace(content[:len(content)-2]),
 		},
 		{
 			name:    "extract the whole from a different directory",
-			cmd:     command{Path: "code.go", Lang: "go", Type: typeCode},
+			cmd:     Command{Path: "code.go", Lang: "go", Type: typeCode},
 			baseDir: "sample",
 			files:   map[string][]byte{"sample/code.go": []byte(content)},
 			out:     "```go\n" + string(content) + "```\n",
 		},
 		{
 			name:  "added line break",
-			cmd:   command{Path: "code.go", Lang: "go", Start: ptr("/fmt\\.Println/"), Type: typeCode},
+			cmd:   Command{Path: "code.go", Lang: "go", Start: ptr("/fmt\\.Println/"), Type: typeCode},
 			files: map[string][]byte{"code.go": []byte(content)},
 			out:   "```go\nfmt.Println\n```\n",
 		},
+		{
+			name:  "content with code fences",
+			cmd:   Command{Path: "docs.md", Lang: "markdown", Type: typeCode},
+			files: map[string][]byte{"docs.md": []byte("# Docs\n```go\n" + content + "```\n`````\n")},
+			out:   "``````markdown\n# Docs\n```go\n" + content + "```\n`````\n``````\n",
+		},
+		{
+			name:  "inferred language",
+			cmd:   Command{Path: "Dockerfile", Type: typeCode},
+			files: map[string][]byte{"Dockerfile": []byte("FROM scratch\n")},
+			out:   "```dockerfile\nFROM scratch\n```\n",
+		},
+		{
+			name:  "language can't be inferred",
+			cmd:   Command{Path: "LICENSE", Type: typeCode},
+			files: map[string][]byte{"LICENSE": []byte("Apache\n")},
+			err:   "language is required for LICENSE, as it can't be inferred from its name or content",
+		},
+		{
+			name:  "no language needed in yaml mode",
+			cmd:   Command{Path: "LICENSE", Type: typeCode, yamlMode: true},
+			files: map[string][]byte{"LICENSE": []byte("Apache\n")},
+			out:   "```\nApache\n```\n",
+		},
 		{
 			name: "missing file",
-			cmd:  command{Path: "code.go", Lang: "go"},
+			cmd:  Command{Path: "code.go", Lang: "go"},
 			err:  "could not read code.go: file does not exist",
 		},
 		{
 			name:  "unmatched regexp",
-			cmd:   command{Path: "code.go", Lang: "go", Start: ptr("/potato/")},
+			cmd:   Command{Path: "code.go", Lang: "go", Start: ptr("/potato/")},
 			files: map[string][]byte{"code.go": []byte(content)},
 			err:   "could not extract content from code.go: could not match \"/potato/\"",
 		},
@@ -191,6 +302,46 @@ func TestExtractFromFile(t *testing.T) {
 	}
 }
 
+func TestResolveMount(t *testing.T) {
+	e := embedder{baseDir: "docs", mounts: map[string]string{
+		"$lgtm":          "https://example.com/lgtm/",
+		"$lgtm2":         "https://example.com/lgtm2",
+		"$lgtm/examples": "/examples",
+		"$shared":        "../shared",
+	}}
+	tc := []struct {
+		path string
+		dir  string
+		out  string
+		err  string
+	}{
+		{path: "code.go", dir: "docs", out: "code.go"},
+		{path: "/etc/passwd", dir: "docs", out: "/etc/passwd"},
+		{path: "$lgtm/go.mod", dir: "docs", out: "https://example.com/lgtm/go.mod"},
+		{path: "$lgtm2/go.mod", dir: "docs", out: "https://example.com/lgtm2/go.mod"},
+		{path: "$lgtm/examples/go/go.mod", out: "/examples/go/go.mod"},
+		{path: "$lgtm/examples2/go.mod", dir: "docs", out: "https://example.com/lgtm/examples2/go.mod"},
+		{path: "$shared/go.mod", dir: "docs", out: "../shared/go.mod"},
+		{path: "docs/$lgtm/go.mod", dir: "docs", out: "docs/$lgtm/go.mod"},
+		{path: "$lgtm", dir: "docs", out: "https://example.com/lgtm"},
+		{path: "$lgtm3/go.mod", err: "unknown mount $lgtm3"},
+		{path: "$lgtmgo.mod", err: "unknown mount $lgtmgo.mod"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.path, func(t *testing.T) {
+			dir, out, err := e.resolveMount(tt.path)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+			assert.Equal(t, tt.dir, dir)
+			assert.Equal(t, tt.out, out)
+		})
+	}
+}
+
 type fakeFileProvider map[string][]byte
 
 func (c fakeFileProvider) Fetch(dir, path string) ([]byte, error) {
@@ -218,6 +369,13 @@ func TestProcess(t *testing.T) {
 				"Yay!\n",
 			err: "2: could not read code.go: file does not exist",
 		},
+		{
+			name:  "html comment with only an end",
+			in:    "<!-- embedmd src=code.go end=\"/import/\" -->\n",
+			files: map[string][]byte{"code.go": []byte(content)},
+			out: "<!-- embedmd src=code.go end=\"/import/\" -->\n" +
+				"```go\n\npackage main\n\nimport\n```\n",
+		},
 		{
 			name: "generating code for first time",
 			in: "# This is some markdown\n" +
@@ -261,6 +419,21 @@ func TestProcess(t *testing.T) {
 				"```\n" +
 				"Yay!\n",
 		},
+		{
+			name: "embedding code in a blockquote",
+			in: "> Quote\n" +
+				"> [embedmd]:# (code.go)\n" +
+				"Yay!\n",
+			files: map[string][]byte{"code.go": []byte("package main\n\nfunc main() {}\n")},
+			out: "> Quote\n" +
+				"> [embedmd]:# (code.go)\n" +
+				"> ```go\n" +
+				"> package main\n" +
+				">\n" +
+				"> func main() {}\n" +
+				"> ```\n" +
+				"Yay!\n",
+		},
 		{
 			name: "embedding code from a URL",
 			in: "# This is some markdown\n" +
@@ -274,6 +447,13 @@ func TestProcess(t *testing.T) {
 				"```\n" +
 				"Yay!\n",
 		},
+		{
+			name: "unknown mount",
+			in: "# This is some markdown\n" +
+				"[embedmd]:# ($lgtm/main.go)\n" +
+				"Yay!\n",
+			err: "2: could not read $lgtm/main.go: unknown mount $lgtm",
+		},
 		{
 			name: "embedding code from a URL not found",
 			in: "# This is some markdown\n" +
@@ -325,6 +505,133 @@ func TestProcess(t *testing.T) {
 	}
 }
 
+func TestProcessTwice(t *testing.T) {
+	tc := []struct {
+		name string
+		in   string
+	}{
+		{name: "code",
+			in: "# Title\n[embedmd]:# (code.go)\nYay!\n"},
+		{name: "plain",
+			in: "# Title\n[embedmd]:# (code.go noCode)\n\nYay!\n"},
+		{name: "plain with a template",
+			in: "# Title\n[embedmd]:# (code.go noCode trim template:```go$embed:{newline}{{.Content}}$embed:{newline}```)\n\nYay!\n"},
+		{name: "markdown with code fences",
+			in: "# Title\n[embedmd]:# (docs.md markdown)\nYay!\n"},
+		{name: "in a list",
+			in: "# Title\n1. Step\n\n   [embedmd]:# (code.go)\n2. Step\n"},
+		{name: "plain in a blockquote",
+			in: "# Title\n> > [embedmd]:# (code.go noCode)\nYay!\n"},
+		{name: "crlf without final newline",
+			in: "# Title\r\n[embedmd]:# (code.go)\r\nYay!"},
+		{name: "html comment",
+			in: "# Title\n<!-- embedmd src=code.go noCode -->\n\nYay!\n"},
+		{name: "front matter with placeholders",
+			in: "---\nembed:\n  - src: code.go\n  - src: code.go\n    type: plain\n---\n# Title\n[embedmd-yaml]:#\n\nYay!\n"},
+		{name: "embedmd code section",
+			in: "# Title\n```embedmd\n- src: code.go\n- src: code.go\n  type: plain\n```\n\nYay!\n"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := WithFetcher(fakeFileProvider{
+				"code.go": []byte(content),
+				"docs.md": []byte("# Docs\n````go\n" + content + "````\n"),
+			})
+			var once, twice bytes.Buffer
+			assert.NoError(t, Process(&once, strings.NewReader(tt.in), nil, opts))
+			assert.NoError(t, Process(&twice, bytes.NewReader(once.Bytes()), nil, opts))
+			assert.Equal(t, once.String(), twice.String())
+			assert.Contains(t, once.String(), "fmt.Println")
+		})
+	}
+}
+
+// blockingFetcher blocks every fetch until all the expected ones have started.
+type blockingFetcher struct {
+	fakeFileProvider
+	started *sync.WaitGroup
+}
+
+func (f blockingFetcher) Fetch(dir, path string) ([]byte, error) {
+	f.started.Done()
+	f.started.Wait()
+	return f.fakeFileProvider.Fetch(dir, path)
+}
+
+func TestProcessLegacyPlainOutput(t *testing.T) {
+	tc := []struct {
+		name, in, out, err string
+		legacy             bool
+	}{
+		{name: "without the option",
+			in:  "[embedmd]:# (code.go noCode L2)\npackage old\nimport \"old\"\n\nYay!\n",
+			err: "1: missing [embedmd-end]:# after the output of the command, or a blank line if it has none"},
+		{name: "up to the blank line", legacy: true,
+			in:  "[embedmd]:# (code.go noCode L2)\npackage old\nimport \"old\"\n\nYay!\n",
+			out: "[embedmd]:# (code.go noCode L2)\npackage main\n[embedmd-end]:#\n\nYay!\n"},
+		{name: "up to the end of the blockquote", legacy: true,
+			in:  "> [embedmd]:# (code.go noCode L2)\n> package old\nYay!\n",
+			out: "> [embedmd]:# (code.go noCode L2)\n> package main\n> [embedmd-end]:#\nYay!\n"},
+		{name: "up to the end of the document", legacy: true,
+			in:  "[embedmd]:# (code.go noCode L2)\npackage old\n",
+			out: "[embedmd]:# (code.go noCode L2)\npackage main\n[embedmd-end]:#\n"},
+		{name: "with an end marker", legacy: true,
+			in:  "[embedmd]:# (code.go noCode L2)\npackage old\n\nold\n[embedmd-end]:#\nYay!\n",
+			out: "[embedmd]:# (code.go noCode L2)\npackage main\n[embedmd-end]:#\nYay!\n"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithFetcher(fakeFileProvider{"code.go": []byte(content)})}
+			if tt.legacy {
+				opts = append(opts, WithLegacyPlainOutput())
+			}
+			var out bytes.Buffer
+			err := Process(&out, strings.NewReader(tt.in), nil, opts...)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.out, out.String())
+		})
+	}
+}
+
+func TestProcessPrefetch(t *testing.T) {
+	files := fakeFileProvider{
+		"a.go": []byte("package a\n"),
+		"b.go": []byte("package b\n"),
+	}
+	in := "[embedmd]:# (a.go /package/)\n" +
+		"[embedmd]:# (missing.go)\n" +
+		"[embedmd]:# (b.go)\n" +
+		"[embedmd]:# (a.go)\n" +
+		"[embedmd]:# ($unknown/c.go)\n"
+
+	var started sync.WaitGroup
+	started.Add(3)
+	done := make(chan error)
+	var out bytes.Buffer
+	go func() {
+		done <- Process(&out, strings.NewReader(in), nil, WithFetcher(blockingFetcher{files, &started}))
+	}()
+
+	select {
+	case err := <-done:
+		assert.EqualError(t, err, "2: could not read missing.go: file does not exist")
+	case <-time.After(5 * time.Second):
+		t.Fatal("content was not fetched concurrently")
+	}
+
+	in = "[embedmd]:# (a.go /package/)\n[embedmd]:# (a.go)\n"
+	out.Reset()
+	assert.NoError(t, Process(&out, strings.NewReader(in), nil, WithFetcher(files)))
+	assert.Equal(t, "[embedmd]:# (a.go /package/)\n```go\npackage\n```\n"+
+		"[embedmd]:# (a.go)\n```go\npackage a\n```\n", out.String())
+}
+
 func TestReplace(t *testing.T) {
 	tc := []struct {
 		name  string
@@ -419,7 +726,7 @@ func TestTemplate(t *testing.T) {
 
 	for _, tt := range tc {
 		t.Run(tt.name, func(t *testing.T) {
-			b, err := applyTemplate([]byte(tt.value), tt.template)
+			b, err := applyTemplate([]byte(tt.value), tt.template, nil)
 			assert.NoError(t, err)
 			assert.Equal(t, tt.out, string(b))
 		})
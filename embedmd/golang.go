@@ -0,0 +1,135 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// goDeclKinds are the kinds of declarations that can be selected with go:kind.
+var goDeclKinds = map[string]bool{
+	"func":   true,
+	"method": true,
+	"type":   true,
+	"var":    true,
+	"const":  true,
+}
+
+var goDeclTokens = map[string]token.Token{
+	"type":  token.TYPE,
+	"var":   token.VAR,
+	"const": token.CONST,
+}
+
+// extractGoDecl parses b as a Go file and returns the source of the
+// declaration described by sel, such as "func main", "type Fetcher" or
+// "method embedder.runCommand", including its doc comment.
+func extractGoDecl(b []byte, sel string) ([]byte, error) {
+	kind, name, _ := strings.Cut(strings.TrimSpace(sel), " ")
+	name = strings.TrimSpace(name)
+	if !goDeclKinds[kind] || name == "" {
+		return nil, fmt.Errorf("invalid go declaration %q", sel)
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", b, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	source := func(doc *ast.CommentGroup, n ast.Node) []byte {
+		start := fset.Position(n.Pos()).Offset
+		if doc != nil {
+			start = fset.Position(doc.Pos()).Offset
+		}
+		// include the indentation of the first line.
+		for start > 0 && (b[start-1] == ' ' || b[start-1] == '\t') {
+			start--
+		}
+		return b[start:fset.Position(n.End()).Offset]
+	}
+
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			switch {
+			case kind == "func" && d.Recv == nil && d.Name.Name == name,
+				kind == "method" && d.Recv != nil && receiverName(d.Recv)+"."+d.Name.Name == name:
+				return source(d.Doc, d), nil
+			}
+		case *ast.GenDecl:
+			if goDeclTokens[kind] != d.Tok {
+				continue
+			}
+			for _, spec := range d.Specs {
+				var doc *ast.CommentGroup
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if s.Name.Name != name {
+						continue
+					}
+					doc = s.Doc
+				case *ast.ValueSpec:
+					if !hasName(s.Names, name) {
+						continue
+					}
+					doc = s.Doc
+				}
+				if !d.Lparen.IsValid() {
+					return source(d.Doc, d), nil
+				}
+				return source(doc, spec), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("could not find go declaration %q", sel)
+}
+
+// receiverName returns the name of the receiver type of a method, without
+// pointers or type parameters.
+func receiverName(recv *ast.FieldList) string {
+	if len(recv.List) == 0 {
+		return ""
+	}
+	expr := recv.List[0].Type
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+func hasName(names []*ast.Ident, name string) bool {
+	for _, n := range names {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
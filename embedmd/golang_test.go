@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const goSource = `package main
+
+// Fetcher fetches things.
+type Fetcher interface {
+	Fetch() error
+}
+
+type (
+	// List is a generic list.
+	List[T any] struct {
+		items []T
+	}
+
+	other int
+)
+
+const answer = 42
+
+// main is the entry point.
+func main() {
+	fmt.Println(` + "`" + `
+}
+` + "`" + `)
+}
+
+// Push adds an item.
+func (l *List[T]) Push(
+	item T,
+) {
+	l.items = append(l.items, item)
+}
+
+func Map[T, U any](in []T, f func(T) U) []U { return nil }
+`
+
+func TestExtractGoDecl(t *testing.T) {
+	tc := []struct {
+		name string
+		sel  string
+		out  string
+		err  string
+	}{
+		{name: "function with doc comment and column 0 brace",
+			sel: "func main",
+			out: "// main is the entry point.\nfunc main() {\n\tfmt.Println(`\n}\n`)\n}"},
+		{name: "generic function",
+			sel: "func Map",
+			out: "func Map[T, U any](in []T, f func(T) U) []U { return nil }"},
+		{name: "method on generic type with multi-line signature",
+			sel: "method List.Push",
+			out: "// Push adds an item.\nfunc (l *List[T]) Push(\n\titem T,\n) {\n\tl.items = append(l.items, item)\n}"},
+		{name: "interface type",
+			sel: "type Fetcher",
+			out: "// Fetcher fetches things.\ntype Fetcher interface {\n\tFetch() error\n}"},
+		{name: "type in a group",
+			sel: "type List",
+			out: "\t// List is a generic list.\n\tList[T any] struct {\n\t\titems []T\n\t}"},
+		{name: "constant",
+			sel: "const answer",
+			out: "const answer = 42"},
+		{name: "method is not a function",
+			sel: "func Push",
+			err: "could not find go declaration \"func Push\""},
+		{name: "unknown kind",
+			sel: "struct List",
+			err: "invalid go declaration \"struct List\""},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := extractGoDecl([]byte(goSource), tt.sel)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+			assert.Equal(t, tt.out, string(b))
+		})
+	}
+}
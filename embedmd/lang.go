@@ -0,0 +1,134 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"path"
+	"strings"
+)
+
+// languages maps file extensions, with their leading dot, and well-known file
+// names to the language of their code blocks. Other extensions are used as the
+// language as they are.
+var languages = map[string]string{
+	".bash":          "bash",
+	".c":             "c",
+	".cc":            "cpp",
+	".cpp":           "cpp",
+	".cs":            "csharp",
+	".h":             "c",
+	".hpp":           "cpp",
+	".htm":           "html",
+	".js":            "javascript",
+	".jsx":           "jsx",
+	".kt":            "kotlin",
+	".markdown":      "markdown",
+	".md":            "markdown",
+	".mjs":           "javascript",
+	".pl":            "perl",
+	".proto":         "protobuf",
+	".ps1":           "powershell",
+	".py":            "python",
+	".rb":            "ruby",
+	".rs":            "rust",
+	".sh":            "sh",
+	".tf":            "hcl",
+	".ts":            "typescript",
+	".tsx":           "tsx",
+	".txt":           "text",
+	".yml":           "yaml",
+	"CMakeLists.txt": "cmake",
+	"Dockerfile":     "dockerfile",
+	"Gemfile":        "ruby",
+	"GNUmakefile":    "makefile",
+	"Jenkinsfile":    "groovy",
+	"Makefile":       "makefile",
+	"Rakefile":       "ruby",
+	"Vagrantfile":    "ruby",
+	"go.mod":         "go",
+	"go.sum":         "text",
+	"makefile":       "makefile",
+}
+
+// interpreters maps the interpreters in shebang lines, without their version,
+// to languages. Other interpreters are used as the language as they are.
+var interpreters = map[string]string{
+	"node":    "javascript",
+	"nodejs":  "javascript",
+	"pwsh":    "powershell",
+	"python":  "python",
+	"ruby":    "ruby",
+	"sh":      "sh",
+	"deno":    "typescript",
+	"ts-node": "typescript",
+}
+
+// WithLanguages provides mappings from file extensions, such as ".tpl", or
+// file names, such as "Jenkinsfile", to the languages used for code blocks when
+// commands have none. They take precedence over the built-in ones.
+func WithLanguages(langs map[string]string) Option {
+	return Option{func(e *embedder) {
+		if e.languages == nil {
+			e.languages = map[string]string{}
+		}
+		for k, v := range langs {
+			e.languages[k] = v
+		}
+	}}
+}
+
+// language returns the language of the file at the given path or URL, which is
+// inferred from its name or, for files with no extension, a shebang line at the
+// start of its content. It returns an empty string if none can be inferred.
+func (e *embedder) language(file string, content []byte) string {
+	name := path.Base(file)
+	ext := path.Ext(strings.TrimPrefix(name, "."))
+	for _, table := range []map[string]string{e.languages, languages} {
+		for _, key := range []string{name, ext, strings.ToLower(ext)} {
+			if lang, ok := table[key]; ok && key != "" {
+				return lang
+			}
+		}
+	}
+	if ext != "" {
+		return ext[1:]
+	}
+	return shebangLanguage(content)
+}
+
+// shebangLanguage returns the language of the interpreter in the shebang line
+// at the start of the given content, such as #!/usr/bin/env python3.
+func shebangLanguage(content []byte) string {
+	line, _, _ := bytes.Cut(content, []byte("\n"))
+	rest, ok := bytes.CutPrefix(line, []byte("#!"))
+	if !ok {
+		return ""
+	}
+	args := strings.Fields(string(rest))
+	if len(args) > 0 && path.Base(args[0]) == "env" {
+		args = args[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	interpreter := strings.TrimRight(path.Base(args[0]), "0123456789.")
+	if lang, ok := interpreters[interpreter]; ok {
+		return lang
+	}
+	return interpreter
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLanguage(t *testing.T) {
+	tc := []struct {
+		name    string
+		path    string
+		content string
+		langs   map[string]string
+		lang    string
+	}{
+		{name: "extension used as is", path: "code.go", lang: "go"},
+		{name: "mapped extension", path: "docs/README.md", lang: "markdown"},
+		{name: "upper case extension", path: "config.YML", lang: "yaml"},
+		{name: "well-known file name", path: "build/Dockerfile", lang: "dockerfile"},
+		{name: "file name in a URL", path: "https://example.com/repo/Makefile", lang: "makefile"},
+		{name: "file name with extension", path: "CMakeLists.txt", lang: "cmake"},
+		{name: "shebang", path: "bin/run", content: "#!/bin/bash\necho hi\n", lang: "bash"},
+		{name: "shebang with env and version", path: "tool", content: "#!/usr/bin/env -S python3.11 -u\n", lang: "python"},
+		{name: "shebang of extension-less dot file", path: ".profile", content: "#!/bin/sh\n", lang: "sh"},
+		{name: "shebang ignored with extension", path: "run.sh", content: "#!/bin/bash\n", lang: "sh"},
+		{name: "no extension nor shebang", path: "LICENSE", content: "Apache\n", lang: ""},
+		{name: "overridden extension", path: "page.tpl", langs: map[string]string{".tpl": "gotemplate"}, lang: "gotemplate"},
+		{name: "overridden built-in", path: "docs.md", langs: map[string]string{".md": "md"}, lang: "md"},
+		{name: "overridden file name", path: "ci/Jenkinsfile", langs: map[string]string{"Jenkinsfile": "jenkins"}, lang: "jenkins"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEmbedder(nil, []Option{WithLanguages(tt.langs)})
+			assert.Equal(t, tt.lang, e.language(tt.path, []byte(tt.content)))
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LockFile is the name of the file holding the checksums of the content of
+// URLs, usually next to the ConfigFile.
+const LockFile = "embedmd.lock"
+
+// A Lock holds the SHA-256 sums of the content of URLs, so changes to their
+// content are detected. It's written as lines with a URL followed by its sum:
+//
+//	https://example.com/go.mod sha256:4f2b...
+//
+// The zero value is an empty lock.
+type Lock struct {
+	mu   sync.Mutex
+	sums map[string]string
+}
+
+// ReadLock reads the lock in the given file.
+func ReadLock(file string) (*Lock, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lock{sums: make(map[string]string)}
+	for i, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "sha256:") {
+			return nil, fmt.Errorf("%s:%d: invalid line %q", file, i+1, line)
+		}
+		l.sums[fields[0]] = fields[1]
+	}
+	return l, nil
+}
+
+// Write writes the lock into the given file, sorted by URL.
+func (l *Lock) Write(file string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	urls := make([]string, 0, len(l.sums))
+	for url := range l.sums {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	var b bytes.Buffer
+	for _, url := range urls {
+		fmt.Fprintf(&b, "%s %s\n", url, l.sums[url])
+	}
+	return os.WriteFile(file, b.Bytes(), 0644)
+}
+
+// LockingFetcher returns a Fetcher that fetches with the given Fetcher, or the
+// default one if nil, and checks that the content of URLs matches their sum in
+// the lock. URLs missing from the lock are an error too. With update, the sums
+// of the fetched content are recorded in the lock instead. Only http and https
+// URLs are verified, not the ones with the schemes added with WithScheme.
+func LockingFetcher(f Fetcher, l *Lock, update bool) Fetcher {
+	if f == nil {
+		f = fetcher{}
+	}
+	return lockingFetcher{Fetcher: f, lock: l, update: update}
+}
+
+type lockingFetcher struct {
+	Fetcher
+	lock   *Lock
+	update bool
+}
+
+func (f lockingFetcher) Fetch(dir, path string) ([]byte, error) {
+	// only remote content is verified, not files or file: and data: URLs.
+	b, err := f.Fetcher.Fetch(dir, path)
+	if s := urlScheme(path); err != nil || s != "http" && s != "https" {
+		return b, err
+	}
+
+	sum := lockSum(b)
+	f.lock.mu.Lock()
+	defer f.lock.mu.Unlock()
+	if f.update {
+		if f.lock.sums == nil {
+			f.lock.sums = make(map[string]string)
+		}
+		f.lock.sums[path] = sum
+		return b, nil
+	}
+	want, ok := f.lock.sums[path]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in %s, update it with -update-lock", path, LockFile)
+	}
+	if sum != want {
+		return nil, fmt.Errorf("content of %s has changed: got %s, but %s has %s; review it and update the lock with -update-lock", path, sum, LockFile, want)
+	}
+	return b, nil
+}
+
+// lockSum returns the sum of the given content, as written in the lock.
+func lockSum(b []byte) string {
+	h := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
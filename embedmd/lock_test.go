@@ -0,0 +1,95 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedmd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const mainURL = "https://fakeurl.com/main.go"
+
+func TestLockingFetcher(t *testing.T) {
+	cp := mixedContentProvider{
+		files: map[string][]byte{"code.go": []byte(content)},
+		urls: map[string][]byte{
+			mainURL:                      []byte(content),
+			"https://fakeurl.com/new.go": []byte(content),
+		},
+	}
+	sum := lockSum([]byte(content))
+
+	tc := []struct {
+		name string
+		path string
+		sums map[string]string
+		err  string
+	}{
+		{name: "matching sum", path: mainURL, sums: map[string]string{mainURL: sum}},
+		{name: "files are not locked", path: "code.go", sums: map[string]string{}},
+		{
+			name: "changed content",
+			path: mainURL,
+			sums: map[string]string{mainURL: "sha256:0000"},
+			err:  "content of https://fakeurl.com/main.go has changed: got " + sum + ", but embedmd.lock has sha256:0000; review it and update the lock with -update-lock",
+		},
+		{
+			name: "missing sum",
+			path: "https://fakeurl.com/new.go",
+			sums: map[string]string{mainURL: sum},
+			err:  "https://fakeurl.com/new.go is not in embedmd.lock, update it with -update-lock",
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			f := LockingFetcher(cp, &Lock{sums: tt.sums}, false)
+			b, err := f.Fetch(".", tt.path)
+			if !eqErr(t, tt.name, err, tt.err) {
+				return
+			}
+			assert.Equal(t, content, string(b))
+		})
+	}
+}
+
+func TestUpdateLock(t *testing.T) {
+	cp := mixedContentProvider{urls: map[string][]byte{mainURL: []byte(content)}}
+	l := &Lock{}
+	f := LockingFetcher(cp, l, true)
+	_, err := f.Fetch(".", mainURL)
+	assert.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), LockFile)
+	assert.NoError(t, l.Write(file))
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, mainURL+" "+lockSum([]byte(content))+"\n", string(b))
+
+	read, err := ReadLock(file)
+	assert.NoError(t, err)
+	assert.Equal(t, l.sums, read.sums)
+}
+
+func TestReadLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), LockFile)
+	_, err := ReadLock(file)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.NoError(t, os.WriteFile(file, []byte("https://a.com/b.go sha256:1234\n\nhttps://a.com/c.go\n"), 0644))
+	_, err = ReadLock(file)
+	assert.EqualError(t, err, file+`:3: invalid line "https://a.com/c.go"`)
+}
@@ -15,143 +15,711 @@ package embedmd
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v3"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
-type commandRunner func(io.Writer, *command) error
+type commandRunner func(io.Writer, *Command) error
 
 func process(out io.Writer, in io.Reader, run commandRunner) error {
-	s := &countingScanner{bufio.NewScanner(in), 0}
+	d, err := Parse(in)
+	if err != nil {
+		return err
+	}
+	return render(out, d, run)
+}
+
+// Parse reads markdown from the given io.Reader and returns the Document it
+// contains, without running any of its embedmd commands.
+func Parse(in io.Reader) (*Document, error) {
+	return parseDocument(in, false)
+}
+
+// parseDocument parses a document, taking the output of plain commands with no
+// end marker up to the next blank line with legacyPlain.
+func parseDocument(in io.Reader, legacyPlain bool) (*Document, error) {
+	s := &countingScanner{r: bufio.NewReader(in), legacyPlain: legacyPlain}
+	d := &Document{}
 
-	state := parsingText
+	var st state = parsingText
 	var err error
-	for state != nil {
-		state, err = state(out, s, run)
-		if err != nil {
-			return fmt.Errorf("%d: %v", s.line, err)
+	for st != nil {
+		st, err = st(d, s)
+		if le, ok := err.(lineError); ok {
+			return nil, le
+		} else if err != nil {
+			return nil, fmt.Errorf("%d: %v", s.line, err)
 		}
 	}
 
 	if err := s.Err(); err != nil {
-		return fmt.Errorf("%d: %v", s.line, err)
+		return nil, fmt.Errorf("%d: %v", s.line, err)
 	}
-	return nil
+	d.CRLF = s.crlf
+	d.NoFinalNewline = s.noFinalNewline
+	return d, nil
 }
 
+// countingScanner reads the lines of a document, with no limit on their
+// length, counting them for error messages. The line ending of the first line
+// is taken as the one of the whole document.
 type countingScanner struct {
-	*bufio.Scanner
-	line int
+	r       *bufio.Reader
+	err     error
+	line    int
+	text    string
+	pending []string // lines given back with unread, last one first.
+
+	crlf, noFinalNewline, ending bool
+
+	// lists holds the content columns of the list items the text is in, as
+	// tracked by trackLists, and afterBlank whether the last line was blank.
+	lists      []int
+	afterBlank bool
+
+	// legacyPlain makes parsingPlain take the output of plain commands with
+	// no end marker up to the next blank line.
+	legacyPlain bool
 }
 
 func (c *countingScanner) Scan() bool {
-	b := c.Scanner.Scan()
-	if b {
+	if n := len(c.pending); n > 0 {
+		c.text, c.pending = c.pending[n-1], c.pending[:n-1]
 		c.line++
+		return true
+	}
+	if c.err != nil {
+		return false
+	}
+	text, err := c.r.ReadString('\n')
+	if err != nil {
+		c.err = err
+		if err != io.EOF || text == "" {
+			return false
+		}
+		c.noFinalNewline = true
+	} else if !c.ending {
+		c.crlf, c.ending = strings.HasSuffix(text, "\r\n"), true
+	}
+	text = strings.TrimSuffix(text, "\n")
+	c.text = strings.TrimSuffix(text, "\r")
+	c.line++
+	return true
+}
+
+func (c *countingScanner) Text() string { return c.text }
+
+// Err returns the first error found reading the document, other than io.EOF.
+func (c *countingScanner) Err() error {
+	if c.err == io.EOF {
+		return nil
+	}
+	return c.err
+}
+
+// unread gives back the given lines, which will be returned by the following
+// calls to Scan in the same order.
+func (c *countingScanner) unread(lines ...string) {
+	for i := len(lines) - 1; i >= 0; i-- {
+		c.pending = append(c.pending, lines[i])
+		c.line--
 	}
-	return b
 }
 
-type state func(io.Writer, *countingScanner, commandRunner) (state, error)
+type state func(*Document, *countingScanner) (state, error)
 
-func parsingText(out io.Writer, s *countingScanner, run commandRunner) (state, error) {
+// lineError is an error found at a line other than the one being parsed, such
+// as a line of the front matter.
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e lineError) Error() string { return fmt.Sprintf("%d: %v", e.line, e.err) }
+
+func parsingText(d *Document, s *countingScanner) (state, error) {
 	if !s.Scan() {
 		return nil, nil // end of file, which is fine.
 	}
 
-	if s.line == 2 && s.Text() == "embed:" { // line numbers start with 1
-		//parse until line with "---" whole file with yaml command
-		return yamlParser{}.parse, nil
+	if s.line == 1 && (s.Text() == "---" || s.Text() == "+++" || s.Text() == "{") {
+		return parsingFrontMatter, nil
 	}
 
+	s.trackLists(s.Text())
 	switch line := s.Text(); {
-	case strings.HasPrefix(line, "[embedmd]:#"):
+	case isDirective(line[len(linePrefix(line)):]) && s.inDirectiveIndent(line):
 		return parsingCmd, nil
-	case strings.HasPrefix(line, "```"):
-		return codeParser{print: true}.parse, nil
+	case isPlaceholder(line) && d.frontMatter() != nil:
+		return parsingPlaceholder(d, s)
+	case isFence(line[len(s.containerPrefix(line)):]):
+		block := &CodeBlock{Line: s.line, Open: line}
+		d.Nodes = append(d.Nodes, block)
+		return codeParser{block: block, prefix: s.containerPrefix(line), next: parsingText}.parse, nil
 	default:
-		fmt.Fprintln(out, s.Text())
+		d.addText(s.line, line)
 		return parsingText, nil
 	}
 }
 
-func parsingCmd(out io.Writer, s *countingScanner, run commandRunner) (state, error) {
+func parsingCmd(d *Document, s *countingScanner) (state, error) {
 	line := s.Text()
-	fmt.Fprintln(out, line)
-	args := line[strings.Index(line, "#")+1:]
-	cmd, err := parseCommand(args)
+	prefix := linePrefix(line)
+	cmd, err := ParseCommand(line[len(prefix):])
 	if err != nil {
 		return nil, err
 	}
-	if err := run(out, cmd); err != nil {
-		return nil, err
+	e := &Embed{Line: s.line, Directive: line, Prefix: prefix, Command: cmd}
+	d.Nodes = append(d.Nodes, e)
+	return parsingOutputs([]*Embed{e}, parsingText), nil
+}
+
+// parsingOutputs returns a state parsing the output of the previous run of each
+// of the given embeds, which follow each other, and then continues with next.
+func parsingOutputs(embeds []*Embed, next state) state {
+	for i := len(embeds) - 1; i >= 0; i-- {
+		e, then := embeds[i], next
+		next = func(d *Document, s *countingScanner) (state, error) {
+			if e.Command.Type == typePlain {
+				return parsingPlain(e, s, then)
+			}
+			return previousCode(e, s, then)
+		}
 	}
+	return next
+}
+
+// previousCode takes the code section right after a command, if any, as the
+// output of the previous run of the command.
+func previousCode(e *Embed, s *countingScanner, next state) (state, error) {
 	if !s.Scan() {
-		return nil, nil // end of file, which is fine.
+		return next, nil
+	}
+	if line, ok := stripPrefix(s.Text(), e.Prefix); ok && isFence(line) {
+		block := &CodeBlock{Line: s.line, Open: s.Text()}
+		return codeParser{block: block, embed: e, prefix: e.Prefix, next: next}.parse, nil
+	}
+	s.unread(s.Text())
+	return next, nil
+}
+
+// plainEndMarker is written after the output of plain commands, so the output
+// can be replaced the next time the file is processed. htmlEndMarker is used
+// instead for commands written as HTML comments.
+const (
+	plainEndMarker = "[embedmd-end]:#"
+	htmlEndMarker  = "<!-- embedmd-end -->"
+)
+
+// isDirective reports whether the line holds an embedmd command.
+func isDirective(line string) bool {
+	return strings.HasPrefix(line, "[embedmd]:#") || strings.HasPrefix(line, htmlPrefix)
+}
+
+func isEndMarker(line string) bool {
+	return strings.HasPrefix(line, plainEndMarker) || strings.HasPrefix(line, htmlEndMarker)
+}
+
+// prefixRegexp matches the indentation and blockquote markers of a line, which
+// are kept for the output of commands in lists and blockquotes.
+var prefixRegexp = regexp.MustCompile(`^(?:[ \t]*>)*[ \t]*`)
+
+func linePrefix(line string) string {
+	return prefixRegexp.FindString(line)
+}
+
+// quoteRegexp matches the blockquote markers of a line, and the blank
+// following them. listItemRegexp matches the marker of a list item.
+var (
+	quoteRegexp    = regexp.MustCompile(`^(?:[ \t]*>)+[ \t]?`)
+	listItemRegexp = regexp.MustCompile(`^[ \t]*(?:[-+*]|\d{1,9}[.)])(?:[ \t]+|$)`)
+)
+
+// indentation returns the content of a line without its blockquote markers,
+// and the columns it's indented by.
+func indentation(line string) (content string, cols int) {
+	content = line[len(quoteRegexp.FindString(line)):]
+	return content, columns(content[:len(content)-len(strings.TrimLeft(content, " \t"))])
+}
+
+// columns returns the width of the given blanks, with tab stops of 4.
+func columns(s string) int {
+	n := 0
+	for _, c := range s {
+		if c == '\t' {
+			n += 4 - n%4
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// trackLists keeps track of the list items a line of text is in, so directives
+// indented as their content aren't taken as indented code. A line with no
+// indentation after a blank one ends all of them.
+func (c *countingScanner) trackLists(line string) {
+	content, indent := indentation(line)
+	if strings.TrimSpace(content) == "" {
+		c.afterBlank = true
+		return
 	}
-	if strings.HasPrefix(s.Text(), "```") {
-		return codeParser{print: false}.parse, nil
+	if m := listItemRegexp.FindString(content); m != "" {
+		for len(c.lists) > 0 && c.lists[len(c.lists)-1] > indent {
+			c.lists = c.lists[:len(c.lists)-1]
+		}
+		c.lists = append(c.lists, columns(m))
+	} else if indent == 0 && c.afterBlank {
+		c.lists = nil
 	}
-	fmt.Fprintln(out, s.Text())
-	return parsingText, nil
+	c.afterBlank = false
 }
 
-type codeParser struct{ print bool }
+// inDirectiveIndent reports whether a line holding a directive is indented by
+// less than four columns, or as the content of a list item it's in. Otherwise,
+// it is part of an indented code block, as in an example of a directive.
+func (c *countingScanner) inDirectiveIndent(line string) bool {
+	_, indent := indentation(line)
+	if indent < 4 {
+		return true
+	}
+	for _, col := range c.lists {
+		if col <= indent && indent < col+4 {
+			return true
+		}
+	}
+	return false
+}
 
-func (c codeParser) parse(out io.Writer, s *countingScanner, run commandRunner) (state, error) {
-	if c.print {
-		fmt.Fprintln(out, s.Text())
+// containerPrefix returns the blockquote markers of a line and, if it's in a
+// list item, the indentation of the content of the item, so the rest of the
+// line can be parsed as a fence.
+func (c *countingScanner) containerPrefix(line string) string {
+	prefix := quoteRegexp.FindString(line)
+	content, indent := indentation(line)
+	col := 0
+	for _, l := range c.lists {
+		if l <= indent && indent < l+4 && l > col {
+			col = l
+		}
+	}
+	n := 0
+	for cols := 0; cols < col; n++ {
+		cols = columns(content[:n+1])
 	}
+	return prefix + content[:n]
+}
+
+// stripPrefix removes the given prefix from the line, reporting whether the
+// line had it. Empty lines in blockquotes might lack the blanks of the prefix.
+func stripPrefix(line, prefix string) (string, bool) {
+	if strings.HasPrefix(line, prefix) {
+		return line[len(prefix):], true
+	}
+	if line == strings.TrimRight(prefix, " \t") {
+		return "", true
+	}
+	return line, false
+}
+
+// parsingPlain takes everything up to the end marker following a plain command
+// as the output of its previous run. Without an end marker, the command has no
+// previous output if it's followed by a blank line, or by nothing, and for
+// files processed before end markers were introduced, a code section right
+// after the command is taken. Anything else is an error, rather than guessing
+// where the previous output ends, unless the document is parsed with
+// legacyPlain to migrate it.
+func parsingPlain(e *Embed, s *countingScanner, next state) (state, error) {
+	// plain commands in the previous output, when embedding markdown, come
+	// with their own end markers.
+	var previous []string
+	for nested := 0; s.Scan(); {
+		previous = append(previous, s.Text())
+		line, ok := stripPrefix(s.Text(), e.Prefix)
+		if !ok {
+			break
+		}
+		if isEndMarker(line) {
+			if nested == 0 {
+				e.Output = previous
+				return next, nil
+			}
+			nested--
+		}
+		if isDirective(line) {
+			if c, err := ParseCommand(line); err == nil && c.Type == typePlain {
+				nested++
+			}
+		}
+	}
+	s.unread(previous...)
+	if len(previous) == 0 {
+		return next, nil
+	}
+	first, ok := stripPrefix(previous[0], e.Prefix)
+	switch {
+	case !ok || strings.TrimSpace(first) == "":
+		return next, nil
+	case isFence(first):
+		return previousCode(e, s, next)
+	case s.legacyPlain:
+		n := 0
+		for ; n < len(previous); n++ {
+			if line, ok := stripPrefix(previous[n], e.Prefix); !ok || strings.TrimSpace(line) == "" {
+				break
+			}
+			s.Scan()
+		}
+		e.Output = previous[:n]
+		return next, nil
+	}
+	marker := plainEndMarker
+	if strings.HasPrefix(e.Directive[len(e.Prefix):], htmlPrefix) {
+		marker = htmlEndMarker
+	}
+	return nil, fmt.Errorf("missing %s after the output of the command, or a blank line if it has none", marker)
+}
+
+// codeParser parses a code section, which is either part of the document or
+// the output of the previous run of an embed command.
+type codeParser struct {
+	block  *CodeBlock
+	embed  *Embed
+	prefix string // of every line of the code section.
+	next   state
+}
+
+func (c codeParser) parse(d *Document, s *countingScanner) (state, error) {
+	// code in a blockquote or a list item ends with it, closed or not.
+	inContainer := c.embed == nil && c.prefix != ""
 	if !s.Scan() {
+		if inContainer {
+			return c.next, nil
+		}
 		return nil, fmt.Errorf("unbalanced code section")
 	}
-	if !strings.HasPrefix(s.Text(), "```") {
+	open, _ := stripPrefix(c.block.Open, c.prefix)
+	line, ok := stripPrefix(s.Text(), c.prefix)
+	if !ok && inContainer {
+		// the closing fence of code in a list item might be less indented
+		// than its content.
+		line, ok = stripPrefix(s.Text(), strings.TrimRight(c.prefix, " \t"))
+		if !ok && strings.Contains(c.prefix, ">") {
+			s.unread(s.Text())
+			return c.next, nil
+		}
+	}
+	if !ok || !closesFence(open, line) {
+		c.block.Lines = append(c.block.Lines, s.Text())
 		return c.parse, nil
 	}
 
-	// print the end of the code section if needed and go back to parsing text.
-	if c.print {
-		fmt.Fprintln(out, s.Text())
+	c.block.Close = s.Text()
+	if c.embed != nil {
+		c.embed.Output = append(append([]string{c.block.Open}, c.block.Lines...), c.block.Close)
+	} else if c.block.Info() == "embedmd" {
+		return parsingYAMLBlock(d, c.block)
 	}
-	return parsingText, nil
+	return c.next, nil
 }
 
-type yamlParser struct {
-	yaml []string
-	drop bool
+// parseFence returns the fence opening a code section in the given line, if
+// any, following the CommonMark rules: up to three spaces of indentation and at
+// least three backticks or tildes, with no backticks in the info string of a
+// backtick fence.
+func parseFence(line string) (fence, info string, ok bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 || (trimmed[0] != '`' && trimmed[0] != '~') {
+		return "", "", false
+	}
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, trimmed[:1]))
+	if n < 3 {
+		return "", "", false
+	}
+	fence, info = trimmed[:n], strings.TrimSpace(trimmed[n:])
+	if fence[0] == '`' && strings.Contains(info, "`") {
+		return "", "", false
+	}
+	return fence, info, true
 }
 
-func (c yamlParser) parse(out io.Writer, s *countingScanner, run commandRunner) (state, error) {
-	if c.drop {
-		if !s.Scan() {
-			return nil, nil
+func isFence(line string) bool {
+	_, _, ok := parseFence(line)
+	return ok
+}
+
+// closesFence reports whether the given line closes the code section opened
+// by open, which requires a fence of the same character at least as long as
+// the opening one and nothing but blanks after it.
+func closesFence(open, line string) bool {
+	opening, _, _ := parseFence(open)
+	closing, info, ok := parseFence(line)
+	return ok && info == "" && closing[0] == opening[0] && len(closing) >= len(opening)
+}
+
+// parsingYAMLBlock parses the YAML commands in an embedmd code section, whose
+// outputs follow the code section.
+func parsingYAMLBlock(d *Document, block *CodeBlock) (state, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte(strings.Join(block.Lines, "\n")), &n); err != nil {
+		return nil, err
+	}
+	if len(n.Content) == 0 {
+		return nil, fmt.Errorf("missing command in embedmd code section")
+	}
+	embeds, err := yamlEmbeds(n.Content[0], block.Line+1)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range embeds {
+		e.Block = block
+		d.Nodes = append(d.Nodes, e)
+	}
+	return parsingOutputs(embeds, parsingText), nil
+}
+
+// parsingFrontMatter parses the YAML, TOML or JSON front matter of a document.
+// Only front matter whose embed key holds a command or a list of commands is
+// taken as such, otherwise it is parsed as text.
+func parsingFrontMatter(d *Document, s *countingScanner) (state, error) {
+	f := &FrontMatter{Line: 1}
+	first := s.Text()
+	var lines, scanned []string
+	closed := false
+	for !closed && s.Scan() {
+		line := s.Text()
+		scanned = append(scanned, line)
+		if first == "{" {
+			lines = append(lines, line)
+			closed = strings.TrimSpace(line) == "}" && json.Valid([]byte(strings.Join(append([]string{first}, lines...), "\n")))
+		} else if closed = line == first; !closed {
+			lines = append(lines, line)
 		}
+	}
+	if first == "{" {
+		lines = append([]string{first}, lines...)
 	} else {
-		fmt.Fprintln(out, s.Text())
-		if !s.Scan() {
+		f.Delimiter = first
+	}
+
+	// embed as the first key makes the document a YAML mode one. Errors in
+	// it, or in TOML or JSON front matter with an embed table or key, are
+	// reported.
+	required := first == "---" && len(lines) > 0 && lines[0] == "embed:"
+	strict := required || first != "---" && embedKeyRegexp.MatchString(strings.Join(lines, "\n"))
+	if !closed && strict {
+		switch first {
+		case "---":
 			return nil, fmt.Errorf("unbalanced yaml section")
+		case "+++":
+			return nil, fmt.Errorf("unbalanced toml section")
+		default:
+			return nil, jsonError(lines)
 		}
-		if s.Text() == "---" {
-			fmt.Fprintf(out, "%s\n\n", s.Text())
-			c.drop = true
+	}
 
-			cmd := &command{yamlMode: true, Type: typeCode, IncludeStart: true, IncludeEnd: true}
-			err := yaml.Unmarshal([]byte(strings.Join(c.yaml, "\n")), &cmd)
-			if err != nil {
-				return nil, err
-			}
-			if cmd.Type != typePlain && cmd.Type != typeCode {
-				return nil, fmt.Errorf("invalid type: %s", cmd.Type)
-			}
+	var embed *yaml.Node
+	if closed {
+		var err error
+		embed, err = frontMatterEmbed(f.Delimiter, lines)
+		if err != nil && strict {
+			return nil, err
+		}
+		if !required && !holdsCommands(embed) {
+			embed = nil
+		}
+	}
+	if embed == nil {
+		s.unread(scanned...)
+		d.addText(1, first)
+		return parsingText, nil
+	}
 
-			if err := run(out, cmd); err != nil {
-				return nil, err
+	embeds, err := yamlEmbeds(embed, 2)
+	if err != nil {
+		return nil, err
+	}
+	f.Lines = lines
+	for _, e := range embeds {
+		if f.Delimiter != "---" {
+			e.Line = f.Line
+		}
+		f.Commands = append(f.Commands, e.Command)
+	}
+	d.Nodes = append(d.Nodes, f)
+
+	// with placeholders in the body, the body is parsed as usual.
+	var body []string
+	for s.Scan() {
+		body = append(body, s.Text())
+	}
+	for _, line := range body {
+		if isPlaceholder(line) {
+			s.unread(body...)
+			return parsingText, nil
+		}
+	}
+
+	// otherwise the whole body is the output of the previous run.
+	f.ReplaceBody = true
+	for _, e := range embeds {
+		e.FrontMatter = f
+		d.Nodes = append(d.Nodes, e)
+	}
+	embeds[0].Output = body
+	return nil, nil
+}
+
+// frontMatterEmbed returns the value of the embed key of the front matter as a
+// YAML node, or nil if there is none. TOML values are converted to YAML and
+// JSON is parsed as YAML, so the commands are decoded in the same way.
+func frontMatterEmbed(delim string, lines []string) (*yaml.Node, error) {
+	text := strings.Join(lines, "\n")
+	if delim == "+++" {
+		var fm map[string]interface{}
+		if _, err := toml.Decode(text, &fm); err != nil {
+			var pe toml.ParseError
+			if errors.As(err, &pe) {
+				return nil, lineError{pe.Position.Line + 1, errors.New(pe.Message)}
 			}
-		} else {
-			c.yaml = append(c.yaml, s.Text())
+			return nil, err
 		}
+		if fm["embed"] == nil {
+			return nil, nil
+		}
+		b, err := yaml.Marshal(fm["embed"])
+		if err != nil {
+			return nil, err
+		}
+		var n yaml.Node
+		if err := yaml.Unmarshal(b, &n); err != nil {
+			return nil, err
+		}
+		return n.Content[0], nil
+	}
+
+	var fm struct {
+		Embed yaml.Node `yaml:"embed"`
+	}
+	if err := yaml.Unmarshal([]byte(text), &fm); err != nil {
+		return nil, err
+	}
+	if fm.Embed.Kind == 0 {
+		return nil, nil
+	}
+	return &fm.Embed, nil
+}
+
+// embedKeyRegexp matches an embed table or key in TOML or JSON front matter.
+var embedKeyRegexp = regexp.MustCompile(`(?m)^\s*(\[\[?\s*embed\s*\]|embed\s*=)|"embed"\s*:`)
+
+// jsonError returns the error in the JSON front matter in the given lines,
+// which ends at the first closing brace on its own line, with its line.
+func jsonError(lines []string) error {
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "}" {
+			lines = lines[:i+1]
+			break
+		}
+	}
+	text := strings.Join(lines, "\n")
+	var v interface{}
+	err := json.Unmarshal([]byte(text), &v)
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		return lineError{1 + strings.Count(text[:se.Offset], "\n"), fmt.Errorf("invalid JSON front matter: %v", se)}
+	}
+	return lineError{1, fmt.Errorf("invalid JSON front matter: %v", err)}
+}
+
+// holdsCommands reports whether the given node looks like a command, or a list
+// of them, having a src key, rather than an embed key meant for other tools.
+func holdsCommands(n *yaml.Node) bool {
+	if n == nil {
+		return false
+	}
+	items := []*yaml.Node{n}
+	if n.Kind == yaml.SequenceNode {
+		items = n.Content
+	}
+	for _, item := range items {
+		if item.Kind != yaml.MappingNode || !hasKey(item, "src") {
+			return false
+		}
+	}
+	return len(items) > 0
+}
+
+func hasKey(n *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholderPrefix starts the lines where the output of the commands in the
+// front matter is written, followed optionally by the position of one of them
+// in parenthesis, starting at 1.
+const placeholderPrefix = "[embedmd-yaml]:#"
+
+func isPlaceholder(line string) bool {
+	return strings.HasPrefix(line, placeholderPrefix)
+}
+
+// parsingPlaceholder takes the commands of the front matter selected by a
+// placeholder, whose outputs follow the placeholder.
+func parsingPlaceholder(d *Document, s *countingScanner) (state, error) {
+	f := d.frontMatter()
+	cmds := f.Commands
+	if arg := strings.TrimSpace(strings.TrimPrefix(s.Text(), placeholderPrefix)); arg != "" {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(arg, "("), ")"))
+		if err != nil || n < 1 || n > len(cmds) || arg[0] != '(' || arg[len(arg)-1] != ')' {
+			return nil, fmt.Errorf("invalid placeholder argument %s, expected a number between 1 and %d in parenthesis", arg, len(cmds))
+		}
+		cmds = cmds[n-1 : n]
+	}
+
+	d.addText(s.line, s.Text())
+	var embeds []*Embed
+	for _, cmd := range cmds {
+		e := &Embed{Line: s.line, FrontMatter: f, Command: cmd}
+		embeds = append(embeds, e)
+		d.Nodes = append(d.Nodes, e)
+	}
+	return parsingOutputs(embeds, parsingText), nil
+}
+
+// yamlEmbeds decodes a YAML command, or a list of them, whose first line is
+// the given line of the document.
+func yamlEmbeds(n *yaml.Node, line int) ([]*Embed, error) {
+	items := []*yaml.Node{n}
+	switch n.Kind {
+	case yaml.SequenceNode:
+		items = n.Content
+	case yaml.MappingNode:
+	default:
+		return nil, lineError{line + n.Line - 1, errors.New("embed should be a command or a list of commands")}
+	}
+
+	var embeds []*Embed
+	for _, item := range items {
+		cmd := NewCommand("")
+		if err := item.Decode(cmd); err != nil {
+			return nil, err
+		}
+		embeds = append(embeds, &Embed{Line: line + item.Line - 1, Command: cmd})
+	}
+	if len(embeds) == 0 {
+		return nil, fmt.Errorf("embed should be a command or a list of commands")
 	}
-	return c.parse, nil
+	return embeds, nil
 }
@@ -43,7 +43,7 @@ const yamlCommand = `embed:
 `
 
 type yamlReceived struct {
-	Embed *command `yaml:"embed"`
+	Embed *Command `yaml:"embed"`
 }
 
 func TestParser(t *testing.T) {
@@ -68,7 +68,7 @@ func TestParser(t *testing.T) {
 			name: "yaml command",
 			in:   "---\n" + yamlCommand + "\nheadless: true\n---\none\ntwo\nthree\n",
 			out:  "---\n" + yamlCommand + "\nheadless: true\n---\n\nreceived:\n" + yamlCommand,
-			run: func(w io.Writer, cmd *command) error {
+			run: func(w io.Writer, cmd *Command) error {
 				fmt.Fprint(w, "received:\n")
 				encoder := yaml.NewEncoder(w)
 				encoder.SetIndent(2)
@@ -80,11 +80,132 @@ func TestParser(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "yaml commands in front matter",
+			in:   "---\nembed:\n  - src: one.go\n  - src: two.go\ntitle: two\n---\n\nold\n",
+			out:  "---\nembed:\n  - src: one.go\n  - src: two.go\ntitle: two\n---\n\none.go\n\ntwo.go\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprintln(w, cmd.Path)
+				return nil
+			},
+		},
+		{
+			name: "yaml commands in front matter with placeholders",
+			in: "---\nembed:\n  - src: one.go\n  - src: two.go\n    type: plain\n---\n" +
+				"# Title\n[embedmd-yaml]:# (2)\nold\n[embedmd-end]:#\nprose\n[embedmd-yaml]:#\n",
+			out: "---\nembed:\n  - src: one.go\n  - src: two.go\n    type: plain\n---\n" +
+				"# Title\n[embedmd-yaml]:# (2)\ntwo.go\n[embedmd-end]:#\nprose\n[embedmd-yaml]:#\none.go\ntwo.go\n[embedmd-end]:#\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprintln(w, cmd.Path)
+				return nil
+			},
+		},
+		{
+			name: "front matter with an embed value that is not a command",
+			in:   "---\ntitle: Intro\nembed: true\n---\nBody\n",
+			out:  "---\ntitle: Intro\nembed: true\n---\nBody\n",
+		},
+		{
+			name: "front matter with an embed mapping that is not a command",
+			in:   "---\ntitle: Intro\nembed:\n  video: intro.mp4\n---\nBody\n",
+			out:  "---\ntitle: Intro\nembed:\n  video: intro.mp4\n---\nBody\n",
+		},
+		{
+			name: "front matter with commands after other keys",
+			in:   "---\ntitle: Intro\nembed:\n  src: one.go\n---\nold\n",
+			out:  "---\ntitle: Intro\nembed:\n  src: one.go\n---\n\none.go\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprintln(w, cmd.Path)
+				return nil
+			},
+		},
+		{
+			name: "yaml mode front matter with an embed value that is not a command",
+			in:   "---\nembed:\n  true\ntitle: Intro\n---\nBody\n",
+			err:  "3: embed should be a command or a list of commands",
+		},
+		{
+			name: "bad placeholder",
+			in:   "---\nembed:\n  src: one.go\n---\n[embedmd-yaml]:# (2)\n",
+			err:  "5: invalid placeholder argument (2), expected a number between 1 and 1 in parenthesis",
+		},
+		{
+			name: "placeholder without front matter",
+			in:   "[embedmd-yaml]:#\n",
+			out:  "[embedmd-yaml]:#\n",
+		},
+		{
+			name: "toml front matter",
+			in:   "+++\ntitle = \"two\"\n[embed]\nsrc = \"one.go\"\ntype = \"plain\"\n+++\n\nold\n",
+			out:  "+++\ntitle = \"two\"\n[embed]\nsrc = \"one.go\"\ntype = \"plain\"\n+++\n\none.go plain\n",
+			run:  pathAndTypeRunner,
+		},
+		{
+			name: "toml front matter with a list and placeholders",
+			in:   "+++\n[[embed]]\nsrc = \"one.go\"\n[[embed]]\nsrc = \"two.go\"\nreplace = [{pattern = \"a\", replacement = \"b\"}]\n+++\n[embedmd-yaml]:# (2)\n",
+			out:  "+++\n[[embed]]\nsrc = \"one.go\"\n[[embed]]\nsrc = \"two.go\"\nreplace = [{pattern = \"a\", replacement = \"b\"}]\n+++\n[embedmd-yaml]:# (2)\ntwo.go code\n",
+			run:  pathAndTypeRunner,
+		},
+		{
+			name: "toml front matter without embed",
+			in:   "+++\ntitle = \"two\"\n+++\ntext\n",
+			out:  "+++\ntitle = \"two\"\n+++\ntext\n",
+		},
+		{
+			name: "toml front matter with a malformed embed table",
+			in:   "+++\ntitle = \"two\"\n[embed]\nsrc = one.go\n+++\ntext\n",
+			err:  "4: expected value but found \"one\" instead",
+		},
+		{
+			name: "unbalanced toml front matter with embed",
+			in:   "+++\n[embed]\nsrc = \"one.go\"\ntext\n",
+			err:  "4: unbalanced toml section",
+		},
+		{
+			name: "json front matter",
+			in:   "{\n  \"title\": \"two\",\n  \"embed\": {\"src\": \"one.go\", \"includeStart\": false}\n}\ntext\n[embedmd-yaml]:#\n",
+			out:  "{\n  \"title\": \"two\",\n  \"embed\": {\"src\": \"one.go\", \"includeStart\": false}\n}\ntext\n[embedmd-yaml]:#\none.go code\n",
+			run:  pathAndTypeRunner,
+		},
+		{
+			name: "toml front matter with an embed value that is not a command",
+			in:   "+++\nembed = true\n+++\ntext\n",
+			out:  "+++\nembed = true\n+++\ntext\n",
+		},
+		{
+			name: "malformed json front matter with embed",
+			in:   "{\n  \"title\": \"two\"\n  \"embed\": {\"src\": \"one.go\"}\n}\ntext\n",
+			err:  "3: invalid JSON front matter: invalid character '\"' after object key:value pair",
+		},
+		{
+			name: "json front matter without embed",
+			in:   "{\n  \"title\": \"two\"\n}\ntext\n",
+			out:  "{\n  \"title\": \"two\"\n}\ntext\n",
+		},
+		{
+			name: "yaml commands in embedmd code sections",
+			in:   "one\n```embedmd\nsrc: one.go\n```\n```go\nold\n```\ntwo\n```embedmd\nsrc: two.go\ntype: plain\n```\n\nthree\n",
+			out:  "one\n```embedmd\nsrc: one.go\n```\none.go\ntwo\n```embedmd\nsrc: two.go\ntype: plain\n```\ntwo.go\n[embedmd-end]:#\n\nthree\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprintln(w, cmd.Path)
+				return nil
+			},
+		},
+		{
+			name: "bad yaml command in embedmd code section",
+			in:   "```embedmd\nsrc: one.go\ntype: potato\n```\n",
+			err:  "4: invalid type: potato",
+		},
+		{
+			name: "unbalanced yaml section",
+			in:   "---\nembed:\n  src: one.go\n",
+			err:  "3: unbalanced yaml section",
+		},
 		{
 			name: "a command",
 			in:   "one\n[embedmd]:# (code.go)",
-			out:  "one\n[embedmd]:# (code.go)\nOK\n",
-			run: func(w io.Writer, cmd *command) error {
+			out:  "one\n[embedmd]:# (code.go)\nOK",
+			run: func(w io.Writer, cmd *Command) error {
 				if cmd.Path != "code.go" {
 					return fmt.Errorf("bad command")
 				}
@@ -102,8 +223,8 @@ main() {
 }
 ` + "```" + `
 Yay`,
-			out: "one\n[embedmd]:# (code.go)\nOK\nYay\n",
-			run: func(w io.Writer, cmd *command) error {
+			out: "one\n[embedmd]:# (code.go)\nOK\nYay",
+			run: func(w io.Writer, cmd *Command) error {
 				if cmd.Path != "code.go" {
 					return fmt.Errorf("bad command")
 				}
@@ -111,6 +232,76 @@ Yay`,
 				return nil
 			},
 		},
+		{
+			name: "two contiguous commands",
+			in:   "[embedmd]:# (code.go)\n[embedmd]:# (code.go)\n",
+			out:  "[embedmd]:# (code.go)\nOK\n[embedmd]:# (code.go)\nOK\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\n")
+				return nil
+			},
+		},
+		{
+			name: "a plain command",
+			in:   "one\n[embedmd]:# (code.go noCode)\n\nYay\n",
+			out:  "one\n[embedmd]:# (code.go noCode)\nOK\n[embedmd-end]:#\n\nYay\n",
+			run:  plainRunner,
+		},
+		{
+			name: "a plain command at the end of the document",
+			in:   "one\n[embedmd]:# (code.go noCode)\n",
+			out:  "one\n[embedmd]:# (code.go noCode)\nOK\n[embedmd-end]:#\n",
+			run:  plainRunner,
+		},
+		{
+			name: "a plain command without end marker",
+			in:   "one\n[embedmd]:# (code.go noCode)\nold\nYay\n",
+			err:  "2: missing [embedmd-end]:# after the output of the command, or a blank line if it has none",
+		},
+		{
+			name: "an HTML comment plain command without end marker",
+			in:   "one\n<!-- embedmd src=code.go noCode -->\nold\n",
+			err:  "2: missing <!-- embedmd-end --> after the output of the command, or a blank line if it has none",
+		},
+		{
+			name: "a plain command replacing its previous output",
+			in:   "one\n[embedmd]:# (code.go noCode)\nold\n```\ncode\n```\n[embedmd-end]:#\nYay\n",
+			out:  "one\n[embedmd]:# (code.go noCode)\nOK\n[embedmd-end]:#\nYay\n",
+			run:  plainRunner,
+		},
+		{
+			name: "a plain command before another plain command",
+			in:   "[embedmd]:# (code.go noCode)\n\nYay\n[embedmd]:# (code.go noCode)\nold\n[embedmd-end]:#\n",
+			out:  "[embedmd]:# (code.go noCode)\nOK\n[embedmd-end]:#\n\nYay\n[embedmd]:# (code.go noCode)\nOK\n[embedmd-end]:#\n",
+			run:  plainRunner,
+		},
+		{
+			name: "a plain command with previous output containing a plain command",
+			in:   "[embedmd]:# (code.go noCode)\n[embedmd]:# (other.go noCode)\nold\n[embedmd-end]:#\n[embedmd-end]:#\nYay\n",
+			out:  "[embedmd]:# (code.go noCode)\nOK\n[embedmd-end]:#\nYay\n",
+			run:  plainRunner,
+		},
+		{
+			name: "a plain command followed by code from before end markers",
+			in:   "[embedmd]:# (code.go noCode)\n```sh\nold\n```\nYay\n",
+			out:  "[embedmd]:# (code.go noCode)\nOK\n[embedmd-end]:#\nYay\n",
+			run:  plainRunner,
+		},
+		{
+			name: "an HTML comment command",
+			in:   "one\n<!-- embedmd src=code.go -->\n```go\nold\n```\nYay\n",
+			out:  "one\n<!-- embedmd src=code.go -->\nOK\nYay\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\n")
+				return nil
+			},
+		},
+		{
+			name: "a plain HTML comment command replacing its previous output",
+			in:   "<!-- embedmd src=code.go noCode -->\nold\n<!-- embedmd-end -->\nYay\n",
+			out:  "<!-- embedmd src=code.go noCode -->\nOK\n<!-- embedmd-end -->\nYay\n",
+			run:  plainRunner,
+		},
 		{
 			name: "a bad command",
 			in:   "one\n[embedmd]:# (code\n",
@@ -126,6 +317,148 @@ Yay`,
 			in:   "one\n```\nsome code\n",
 			err:  "3: unbalanced code section",
 		},
+		{
+			name: "ignored command in tilde code section",
+			in:   "~~~markdown\n[embedmd]:# (code.go)\n```\n~~~\n",
+			out:  "~~~markdown\n[embedmd]:# (code.go)\n```\n~~~\n",
+		},
+		{
+			name: "ignored command in longer code section",
+			in:   "````markdown\n[embedmd]:# (code.go)\n```go\nfoo\n```\n[embedmd]:# (code.go)\n`````\n",
+			out:  "````markdown\n[embedmd]:# (code.go)\n```go\nfoo\n```\n[embedmd]:# (code.go)\n`````\n",
+		},
+		{
+			name: "ignored command in indented code section",
+			in:   "   ```markdown\n[embedmd]:# (code.go)\n  ```\n",
+			out:  "   ```markdown\n[embedmd]:# (code.go)\n  ```\n",
+		},
+		{
+			name: "closing fence with info string",
+			in:   "~~~\n~~~ foo\n",
+			err:  "2: unbalanced code section",
+		},
+		{
+			name: "not a fence",
+			in:   "``` foo ` bar\n    ```\n[embedmd]:# (code.go)\n",
+			out:  "``` foo ` bar\n    ```\n[embedmd]:# (code.go)\nOK\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\n")
+				return nil
+			},
+		},
+		{
+			name: "a command replacing a tilde code section",
+			in:   "[embedmd]:# (code.go)\n~~~~go\n```\n~~~~\nYay\n",
+			out:  "[embedmd]:# (code.go)\nOK\nYay\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\n")
+				return nil
+			},
+		},
+		{
+			name: "a command in a list",
+			in:   "1. Run:\n\n   [embedmd]:# (code.go)\n   ```go\n   old\n\n   ```\n2. Done\n",
+			out:  "1. Run:\n\n   [embedmd]:# (code.go)\n   ```go\n   OK\n\n   ```\n2. Done\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "```go\nOK\n\n```\n")
+				return nil
+			},
+		},
+		{
+			name: "a command in an indented code block",
+			in:   "Example:\n\n    [embedmd]:# (pathOrURL language /start/ /end/)\n\n> Quoted:\n>\n>     [embedmd]:# (pathOrURL)\n",
+			out:  "Example:\n\n    [embedmd]:# (pathOrURL language /start/ /end/)\n\n> Quoted:\n>\n>     [embedmd]:# (pathOrURL)\n",
+		},
+		{
+			name: "commands in nested lists",
+			in:   "10. Run:\n\n    [embedmd]:# (code.go)\n    - Then:\n\n      [embedmd]:# (code.go)\n\n          [embedmd]:# (example.go)\n\nDone\n\n    [embedmd]:# (example.go)\n",
+			out:  "10. Run:\n\n    [embedmd]:# (code.go)\n    OK\n    - Then:\n\n      [embedmd]:# (code.go)\n      OK\n\n          [embedmd]:# (example.go)\n\nDone\n\n    [embedmd]:# (example.go)\n",
+			run: func(w io.Writer, cmd *Command) error {
+				if cmd.Path != "code.go" {
+					return fmt.Errorf("bad command")
+				}
+				fmt.Fprint(w, "OK\n")
+				return nil
+			},
+		},
+		{
+			name: "a command in a quoted code section",
+			in:   "> ~~~\n> [embedmd]:# (hello.go L1)\n> ~~~\n> more\n> ~~~\n>\n> ```markdown\n> [embedmd]:# (hello.go)\n> ```\n",
+			out:  "> ~~~\n> [embedmd]:# (hello.go L1)\n> ~~~\n> more\n> ~~~\n>\n> ```markdown\n> [embedmd]:# (hello.go)\n> ```\n",
+		},
+		{
+			name: "an unclosed code section ending with its blockquote",
+			in:   "> ```\n> [embedmd]:# (hello.go)\n\n[embedmd]:# (code.go)\n",
+			out:  "> ```\n> [embedmd]:# (hello.go)\n\n[embedmd]:# (code.go)\n```go\nOK\n```\n",
+			run: func(w io.Writer, cmd *Command) error {
+				if cmd.Path != "code.go" {
+					return fmt.Errorf("bad command")
+				}
+				fmt.Fprint(w, "```go\nOK\n```\n")
+				return nil
+			},
+		},
+		{
+			name: "a command in a code section of a list item",
+			in:   "10. Step\n\n    ~~~\n    [embedmd]:# (hello.go)\n    ~~~\n    keep me\n    ~~~\n\n1. Other\n\n   ```\n   [embedmd]:# (hello.go)\n```\n",
+			out:  "10. Step\n\n    ~~~\n    [embedmd]:# (hello.go)\n    ~~~\n    keep me\n    ~~~\n\n1. Other\n\n   ```\n   [embedmd]:# (hello.go)\n```\n",
+		},
+		{
+			name: "a plain command in a blockquote",
+			in:   "> Quote:\n> [embedmd]:# (code.go noCode)\n> old\n>\n> [embedmd-end]:#\nYay\n",
+			out:  "> Quote:\n> [embedmd]:# (code.go noCode)\n> OK\n>\n> [embedmd-end]:#\nYay\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\n\n")
+				return nil
+			},
+		},
+		{
+			name: "a plain command in a blockquote without end marker",
+			in:   "> [embedmd]:# (code.go noCode)\n[embedmd-end]:#\n",
+			out:  "> [embedmd]:# (code.go noCode)\n> OK\n> [embedmd-end]:#\n[embedmd-end]:#\n",
+			run:  plainRunner,
+		},
+		{
+			name: "very long lines",
+			in:   strings.Repeat("a", 1<<20) + "\n[embedmd]:# (code.go)\n" + strings.Repeat("b", 1<<17),
+			out:  strings.Repeat("a", 1<<20) + "\n[embedmd]:# (code.go)\nOK\n" + strings.Repeat("b", 1<<17),
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\n")
+				return nil
+			},
+		},
+		{
+			name: "unbalanced code section after a long line",
+			in:   strings.Repeat("a", 1<<17) + "\n```\n",
+			err:  "2: unbalanced code section",
+		},
+		{
+			name: "crlf line endings",
+			in:   "one\r\n[embedmd]:# (code.go)\r\n```go\r\nold\r\n```\r\ntwo\r\n",
+			out:  "one\r\n[embedmd]:# (code.go)\r\n```go\r\nOK\r\nOK\r\n```\r\ntwo\r\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "```go\nOK\r\nOK\n```\n")
+				return nil
+			},
+		},
+		{
+			name: "crlf line endings without final newline",
+			in:   "one\r\n[embedmd]:# (code.go)",
+			out:  "one\r\n[embedmd]:# (code.go)\r\nOK",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\n")
+				return nil
+			},
+		},
+		{
+			name: "lf line endings with crlf content",
+			in:   "one\n[embedmd]:# (code.go)\n",
+			out:  "one\n[embedmd]:# (code.go)\nOK\nOK\n",
+			run: func(w io.Writer, cmd *Command) error {
+				fmt.Fprint(w, "OK\r\nOK\r\n")
+				return nil
+			},
+		},
 		{
 			name: "two contiguous code sections",
 			in:   "\n```go\nhello\n```\n```go\nbye\n```\n",
@@ -151,3 +484,16 @@ Yay`,
 		})
 	}
 }
+
+func plainRunner(w io.Writer, cmd *Command) error {
+	if cmd.Path != "code.go" {
+		return fmt.Errorf("bad command")
+	}
+	fmt.Fprint(w, "OK")
+	return nil
+}
+
+func pathAndTypeRunner(w io.Writer, cmd *Command) error {
+	fmt.Fprintln(w, cmd.Path, cmd.Type)
+	return nil
+}
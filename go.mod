@@ -3,6 +3,7 @@ module github.com/grafana/embedmd
 go 1.22
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.8.4
 	gopkg.in/yaml.v3 v3.0.1
@@ -20,7 +20,8 @@
 // to the origin of the embedded text.
 //
 // The command receives a list of markdown files, if none is given it
-// reads from the standard input.
+// reads from the standard input. Directories and patterns like ./docs/... are
+// searched recursively for markdown files not ignored by .gitignore files.
 //
 // embedmd supports two flags:
 // -d: will print the difference of the input file with what the output
@@ -37,13 +38,17 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/grafana/embedmd/embedmd"
 	"github.com/pmezard/go-difflib/difflib"
@@ -63,7 +68,7 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
-var mounts arrayFlags
+var mounts, langs arrayFlags
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage: embedmd [flags] [path ...]\n")
@@ -75,14 +80,41 @@ func main() {
 	doDiff := flag.Bool("d", false, "display diffs instead of rewriting files")
 	printVersion := flag.Bool("v", false, "display embedmd version")
 	flag.Var(&mounts, "m", "Mounts for including files or URLs - e.g. -m 'docker-otel-lgtm=https://raw.githubusercontent.com/grafana/docker-otel-lgtm/73272e8995e9c5460d543d0b909317d5877c3855' (can be repeated).")
+	flag.IntVar(&jobs, "j", jobs, "Number of files processed concurrently.")
+	updateLock := flag.Bool("update-lock", false, "Record the checksums of the content of URLs in "+embedmd.LockFile+" instead of verifying them.")
+	offline := flag.Bool("offline", false, "Read URLs only from the cache of their content, failing for the ones not in it.")
+	timeout := flag.Duration("timeout", 0, "Timeout of each attempt to fetch a URL (default 30s).")
+	exts := flag.String("ext", strings.Join(extensions, ","), "Comma separated list of the extensions of markdown files, used to find them in directories.")
+	legacyNoCode := flag.Bool("legacy-nocode", false, "Take the output of noCode commands with no end marker, as written by older versions, up to the next blank line, to add the marker with -w.")
+	flag.Var(&langs, "lang", "Language of files with the given extension or name, when commands have none - e.g. -lang .tpl=gotemplate or -lang Jenkinsfile=groovy (can be repeated).")
 	flag.Usage = usage
-	flag.Parse()
+
+	// flags in the configuration found from the current directory are parsed
+	// as if given before the others, the ones in the configurations of the
+	// processed files are ignored.
+	cfg, err := embedmd.FindConfig(".")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	args := os.Args[1:]
+	if cfg != nil {
+		args = append(cfg.Flags, args...)
+	}
+	flag.CommandLine.Parse(args)
 
 	if *printVersion {
 		fmt.Println("embedmd version: " + version)
 		return
 	}
 
+	extensions = nil
+	for _, ext := range strings.Split(*exts, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			extensions = append(extensions, "."+strings.TrimPrefix(ext, "."))
+		}
+	}
+
 	m := make(map[string]string)
 	for _, mount := range mounts {
 		parts := strings.Split(mount, "=")
@@ -93,22 +125,93 @@ func main() {
 		m["$"+parts[0]] = parts[1]
 	}
 
-	diff, err := embed(flag.Args(), *rewrite, *doDiff, m)
+	l := make(map[string]string)
+	for _, lang := range langs {
+		parts := strings.Split(lang, "=")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			fmt.Fprintf(os.Stderr, "invalid language: %s\n", lang)
+			os.Exit(2)
+		}
+		l[parts[0]] = parts[1]
+	}
+
+	var httpOpts embedmd.HTTPOptions
+	if cfg != nil {
+		httpOpts = cfg.HTTP
+	}
+	if *timeout != 0 {
+		httpOpts.Timeout = *timeout
+	}
+	httpOpts.Offline = httpOpts.Offline || *offline
+	// the content of URLs is cached in the user cache directory by default,
+	// or in a directory relative to the configuration.
+	if httpOpts.CacheDir == "" {
+		if dir, err := os.UserCacheDir(); err == nil {
+			httpOpts.CacheDir = filepath.Join(dir, "embedmd")
+		}
+	} else if !filepath.IsAbs(httpOpts.CacheDir) {
+		httpOpts.CacheDir = filepath.Join(cfg.Dir, httpOpts.CacheDir)
+	}
+
+	// the content of URLs is verified against the lock next to the
+	// configuration, if there's one.
+	fetcher := embedmd.NewFetcher(httpOpts)
+	lockFile := embedmd.LockFile
+	if cfg != nil {
+		lockFile = filepath.Join(cfg.Dir, embedmd.LockFile)
+	}
+	lock, err := readLock(lockFile, *updateLock)
+	if err == nil {
+		fetcher = embedmd.LockingFetcher(fetcher, lock, *updateLock)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// updating the lock only writes the lock, unless -w or -d are given.
+	if *updateLock && !*rewrite && !*doDiff {
+		stdout = io.Discard
+	}
+
+	// every file and URL is fetched once, even if embedded in several files.
+	opts := []embedmd.Option{embedmd.WithFetcher(embedmd.CachingFetcher(fetcher)), embedmd.WithLanguages(l)}
+	if *legacyNoCode {
+		opts = append(opts, embedmd.WithLegacyPlainOutput())
+	}
+	diff, err := embed(flag.Args(), *rewrite, *doDiff, m, opts...)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
+	if *updateLock {
+		if err := lock.Write(lockFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
 	if diff && *doDiff {
 		os.Exit(2)
 	}
 }
 
+// readLock returns the lock in the given file or, to update it, an empty one,
+// so the URLs no longer embedded are removed from it.
+func readLock(file string, update bool) (*embedmd.Lock, error) {
+	if update {
+		return &embedmd.Lock{}, nil
+	}
+	return embedmd.ReadLock(file)
+}
+
 var (
 	stdout io.Writer = os.Stdout
 	stdin  io.Reader = os.Stdin
 )
 
-func embed(paths []string, rewrite, doDiff bool, mounts map[string]string) (foundDiff bool, err error) {
+// jobs is the number of files processed concurrently, which can be changed
+// with -j.
+var jobs = runtime.NumCPU()
+
+func embed(paths []string, rewrite, doDiff bool, mounts map[string]string, opts ...embedmd.Option) (foundDiff bool, err error) {
 	if rewrite && doDiff {
 		return false, fmt.Errorf("error: cannot use -w and -d simultaneously")
 	}
@@ -117,12 +220,19 @@ func embed(paths []string, rewrite, doDiff bool, mounts map[string]string) (foun
 		if rewrite {
 			return false, fmt.Errorf("error: cannot use -w with standard input")
 		}
+		cfg, err := findConfig(".")
+		if err != nil {
+			return false, err
+		}
+		if cfg != nil {
+			opts = append([]embedmd.Option{embedmd.WithConfig(cfg)}, opts...)
+		}
 		if !doDiff {
-			return false, embedmd.Process(stdout, stdin, mounts)
+			return false, embedmd.Process(stdout, stdin, mounts, opts...)
 		}
 
 		var out, in bytes.Buffer
-		if err := embedmd.Process(&out, io.TeeReader(stdin, &in), mounts); err != nil {
+		if err := embedmd.Process(&out, io.TeeReader(stdin, &in), mounts, opts...); err != nil {
 			return false, err
 		}
 		d, err := diff(in.String(), out.String())
@@ -133,12 +243,54 @@ func embed(paths []string, rewrite, doDiff bool, mounts map[string]string) (foun
 		return true, nil
 	}
 
-	for _, path := range paths {
-		d, err := processFile(path, rewrite, doDiff, mounts)
-		if err != nil {
-			return false, fmt.Errorf("%s:%v", path, err)
+	paths, err = expandPaths(paths)
+	if err != nil {
+		return false, err
+	}
+
+	// files are processed by a pool of workers, but their output and errors
+	// are reported in the order of the files. With -w, their output is only
+	// written once all of them are processed, and none is written if any of
+	// them fails, so workers never read a file another one rewrites.
+	type result struct {
+		out  bytes.Buffer
+		diff bool
+		err  error
+	}
+	results := make([]result, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < max(jobs, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				r := &results[i]
+				r.diff, r.err = processFile(&r.out, paths[i], doDiff, mounts, opts...)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, r := range results {
+		if !rewrite {
+			io.Copy(stdout, &r.out)
+		}
+		if r.err != nil {
+			return false, fmt.Errorf("%s:%v", paths[i], r.err)
+		}
+		foundDiff = foundDiff || r.diff
+	}
+	if rewrite {
+		for i, r := range results {
+			if err := writeFile(paths[i], r.out.Bytes()); err != nil {
+				return false, fmt.Errorf("%s:could not write: %v", paths[i], err)
+			}
 		}
-		foundDiff = foundDiff || d
 	}
 	return foundDiff, nil
 }
@@ -163,11 +315,53 @@ func readFile(path string) ([]byte, error) {
 	return ioutil.ReadAll(f)
 }
 
-func processFile(path string, rewrite, doDiff bool, mounts map[string]string) (foundDiff bool, err error) {
-	if filepath.Ext(path) != ".md" {
+func writeFile(path string, b []byte) error {
+	f, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := f.WriteAt(b, 0)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(int64(n))
+}
+
+// configs caches the configuration of each directory, which might be nil.
+var (
+	configsMu sync.Mutex
+	configs   = map[string]*embedmd.Config{}
+)
+
+func findConfig(dir string) (*embedmd.Config, error) {
+	configsMu.Lock()
+	defer configsMu.Unlock()
+	if c, ok := configs[dir]; ok {
+		return c, nil
+	}
+	c, err := embedmd.FindConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	configs[dir] = c
+	return c, nil
+}
+
+func processFile(out io.Writer, path string, doDiff bool, mounts map[string]string, opts ...embedmd.Option) (foundDiff bool, err error) {
+	if !isMarkdown(path) {
 		return false, fmt.Errorf("not a markdown file")
 	}
 
+	// the options given on the command line override the configuration.
+	cfg, err := findConfig(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	if cfg != nil {
+		opts = append([]embedmd.Option{embedmd.WithConfig(cfg)}, opts...)
+	}
+
 	f, err := openFile(path)
 	if err != nil {
 		return false, err
@@ -175,7 +369,8 @@ func processFile(path string, rewrite, doDiff bool, mounts map[string]string) (f
 	defer f.Close()
 
 	buf := new(bytes.Buffer)
-	if err := embedmd.Process(buf, f, mounts, embedmd.WithBaseDir(filepath.Dir(path))); err != nil {
+	opts = append(opts, embedmd.WithBaseDir(filepath.Dir(path)))
+	if err := embedmd.Process(buf, f, mounts, opts...); err != nil {
 		return false, err
 	}
 
@@ -188,19 +383,11 @@ func processFile(path string, rewrite, doDiff bool, mounts map[string]string) (f
 		if err != nil || len(data) == 0 {
 			return false, err
 		}
-		fmt.Fprintf(stdout, "%s", data)
+		fmt.Fprintf(out, "%s", data)
 		return true, nil
 	}
 
-	if rewrite {
-		n, err := f.WriteAt(buf.Bytes(), 0)
-		if err != nil {
-			return false, fmt.Errorf("could not write: %v", err)
-		}
-		return false, f.Truncate(int64(n))
-	}
-
-	io.Copy(stdout, buf)
+	io.Copy(out, buf)
 	return false, nil
 }
 
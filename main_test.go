@@ -15,10 +15,14 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -49,14 +53,22 @@ func TestEmbedStreams(t *testing.T) {
 		},
 		{name: "non empty diff",
 			d:  true,
-			in: "# hello\ntest",
-			out: `@@ -1,2 +1,3 @@
+			in: "# hello\n[embedmd]:# (data:,test lang:text)\n",
+			out: `@@ -1,3 +1,6 @@
  # hello
- test
-+
+ [embedmd]:# (data:,test lang:text)
++` + "```text" + `
++test
++` + "```" + `
+ 
 `,
 			foundDiff: true,
 		},
+		{name: "empty diff without final newline",
+			d:         true,
+			in:        "# hello\r\ntest",
+			foundDiff: false,
+		},
 	}
 
 	defer func(r io.Reader, w io.Writer) { stdin, stdout = r, w }(stdin, stdout)
@@ -93,12 +105,12 @@ func TestEmbedFiles(t *testing.T) {
 		{name: "rewriting a single file",
 			in:  "one\ntwo\nthree",
 			w:   true,
-			out: "one\ntwo\nthree\n",
+			out: "one\ntwo\nthree",
 		},
 		{name: "diffing a single file",
 			in:  "one\ntwo\nthree",
 			d:   true,
-			out: "@@ -1 +1,4 @@\n+one\n+two\n+three\n \n",
+			out: "@@ -1 +1,3 @@\n-\n+one\n+two\n+three\n",
 		},
 	}
 
@@ -123,6 +135,185 @@ func TestEmbedFiles(t *testing.T) {
 	}
 }
 
+func TestEmbedFilesWithConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := "mounts:\n  src: code\nexclude: [\"drafts/*\"]\n"
+	if err := os.WriteFile(filepath.Join(dir, ".embedmd.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "code"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "code", "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(w io.Writer) { stdout = w }(stdout)
+
+	in := "[embedmd]:# ($src/hello.txt)\n"
+	docs := filepath.Join(dir, "docs", "README.md")
+	drafts := filepath.Join(dir, "drafts", "README.md")
+	for _, p := range []string{docs, drafts} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(in), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := in + "```text\nhello\n```\n"
+	tc := []struct {
+		name, path, out string
+	}{
+		{name: "mount from the configuration",
+			path: docs,
+			out:  out},
+		{name: "excluded file named on the command line",
+			path: drafts,
+			out:  out},
+		{name: "excluded file in a directory",
+			path: dir,
+			out:  out},
+	}
+
+	for _, tt := range tc {
+		openFile = newOpenFunc(map[string]string{docs: in, drafts: in})
+		buf := &bytes.Buffer{}
+		stdout = buf
+		if _, err := embed([]string{tt.path}, false, false, nil); err != nil {
+			t.Errorf("case [%s]: unexpected error %v", tt.name, err)
+			continue
+		}
+		if got := buf.String(); tt.out != got {
+			t.Errorf("case [%s]: expected output \n%q; got\n%q", tt.name, tt.out, got)
+		}
+	}
+}
+
+func TestEmbedFilesConcurrently(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(w io.Writer) { stdout = w }(stdout)
+	defer func(n int) { jobs = n }(jobs)
+	jobs = 4
+
+	files := map[string]string{}
+	var paths []string
+	var want string
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("doc%02d.md", i)
+		files[path] = fmt.Sprintf("# %d\n", i)
+		paths = append(paths, path)
+		want += files[path]
+	}
+	openFile = newOpenFunc(files)
+
+	buf := &bytes.Buffer{}
+	stdout = buf
+	if _, err := embed(paths, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("expected output in order\n%q; got\n%q", want, got)
+	}
+
+	files["doc05.md"] = "[embedmd]:# (missing.go)\n"
+	files["doc12.md"] = "[embedmd]:# (missing.go)\n"
+	buf.Reset()
+	_, err := embed(paths, false, false, nil)
+	eqErr(t, "first error", err, "doc05.md:1: could not read missing.go: open missing.go: no such file or directory")
+	if got, want := buf.String(), "# 0\n# 1\n# 2\n# 3\n# 4\n"; got != want {
+		t.Errorf("expected output before the error\n%q; got\n%q", want, got)
+	}
+}
+
+func TestRewriteFiles(t *testing.T) {
+	defer func(f func(string) (file, error)) { openFile = f }(openFile)
+	defer func(n int) { jobs = n }(jobs)
+	jobs = 4
+
+	files := map[string]string{
+		"a.md": "[embedmd]:# (data:,a lang:text)\n\n",
+		"b.md": "[embedmd]:# (data:,b lang:text)\n\n",
+	}
+	written := map[string]string{}
+	var mu sync.Mutex
+	openFile = func(path string) (file, error) {
+		s, ok := files[path]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return &recordingFile{fakeFile: newFakeFile(s), close: func(b string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if b != "" {
+				written[path] = b
+			}
+		}}, nil
+	}
+
+	if _, err := embed([]string{"a.md", "b.md", "a.md"}, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a.md": "[embedmd]:# (data:,a lang:text)\n```text\na\n```\n\n",
+		"b.md": "[embedmd]:# (data:,b lang:text)\n```text\nb\n```\n\n",
+	}
+	if !reflect.DeepEqual(want, written) {
+		t.Errorf("expected files\n%q; got\n%q", want, written)
+	}
+
+	files["c.md"] = "[embedmd]:# (missing.go)\n"
+	written = map[string]string{}
+	_, err := embed([]string{"a.md", "c.md", "b.md"}, true, false, nil)
+	eqErr(t, "failing file", err, "c.md:1: could not read missing.go: open missing.go: no such file or directory")
+	if len(written) != 0 {
+		t.Errorf("expected no file to be rewritten; got %q", written)
+	}
+}
+
+// recordingFile reports what was written to it when it's closed.
+type recordingFile struct {
+	*fakeFile
+	close func(string)
+}
+
+func (f *recordingFile) Close() error {
+	f.close(f.buf.String())
+	return f.fakeFile.Close()
+}
+
+func TestReadLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "embedmd.lock")
+	old := "https://example.com/old.go sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08\n"
+	if err := os.WriteFile(file, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, update := range []bool{false, true} {
+		lock, err := readLock(file, update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(t.TempDir(), "embedmd.lock")
+		if err := lock.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := old
+		if update {
+			want = ""
+		}
+		if got := string(b); got != want {
+			t.Errorf("update %v: expected lock\n%q; got\n%q", update, want, got)
+		}
+	}
+}
+
 func eqErr(t *testing.T, id string, err error, msg string) bool {
 	if err == nil && msg == "" {
 		return true
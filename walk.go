@@ -0,0 +1,222 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grafana/embedmd/embedmd"
+)
+
+// extensions of the markdown files, which can be changed with -ext.
+var extensions = []string{".md"}
+
+func isMarkdown(file string) bool {
+	ext := filepath.Ext(file)
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPaths replaces the directories in the given paths, as well as patterns
+// like ./docs/..., by the markdown files in them and their subdirectories.
+// Other paths are kept as they are, and files found more than once are only
+// kept the first time.
+func expandPaths(paths []string) ([]string, error) {
+	var files []string
+	seen := map[string]bool{}
+	add := func(file string) {
+		key := filepath.Clean(file)
+		if abs, err := filepath.Abs(file); err == nil {
+			key = abs
+		}
+		if !seen[key] {
+			seen[key] = true
+			files = append(files, file)
+		}
+	}
+	for _, p := range paths {
+		root := p
+		if p == "..." || strings.HasSuffix(p, "/...") {
+			if root = strings.TrimSuffix(strings.TrimSuffix(p, "..."), "/"); root == "" {
+				root = "."
+			}
+		} else if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			add(p)
+			continue
+		}
+
+		found, err := markdownFiles(filepath.FromSlash(root))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range found {
+			add(f)
+		}
+	}
+	return files, nil
+}
+
+// markdownFiles returns the markdown files in the directory tree rooted at
+// root, in lexical order, skipping .git directories, the files ignored by
+// .gitignore files in the tree or in its parents up to the repository root, and
+// the files excluded by their configuration.
+func markdownFiles(root string) ([]string, error) {
+	var ig ignorer
+	if err := ig.loadParents(root); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && (d.Name() == ".git" || ig.ignored(p, true)) {
+				return filepath.SkipDir
+			}
+			return ig.load(p)
+		}
+		if !isMarkdown(p) || ig.ignored(p, false) {
+			return nil
+		}
+		cfg, err := findConfig(filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		if cfg == nil || cfg.Includes(p) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// an ignoreRule is a pattern in a .gitignore file in dir, which is absolute.
+type ignoreRule struct {
+	dir      string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignorer holds the rules of .gitignore files, the ones in deeper directories
+// after the ones in their parents.
+type ignorer struct {
+	rules []ignoreRule
+}
+
+// loadParents loads the .gitignore files in the parents of the given directory,
+// up to the root of the git repository it's in.
+func (ig *ignorer) loadParents(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	var parents []string
+	for !isRepoRoot(abs) {
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			// not in a repository, so only the given tree is considered.
+			return nil
+		}
+		abs = parent
+		parents = append(parents, abs)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		if err := ig.load(parents[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isRepoRoot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// load adds the rules in the .gitignore file in the given directory, if any.
+func (ig *ignorer) load(dir string) error {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{dir: abs}
+		line = strings.TrimPrefix(line, `\`) // for patterns starting with # or !.
+		if r.negate = strings.HasPrefix(s.Text(), "!"); r.negate {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+		if r.pattern != "" {
+			ig.rules = append(ig.rules, r)
+		}
+	}
+	return s.Err()
+}
+
+// ignored reports whether the given file or directory is ignored, according to
+// the last rule matching it.
+func (ig *ignorer) ignored(file string, isDir bool) bool {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	ignored := false
+	for _, r := range ig.rules {
+		rel, err := filepath.Rel(r.dir, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if r.dirOnly && !isDir {
+			continue
+		}
+		pattern := r.pattern
+		if !r.anchored {
+			pattern = "**/" + pattern
+		}
+		if embedmd.MatchGlob(pattern, filepath.ToSlash(rel)) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to writing, software distributed
+// under the License is distributed on a "AS IS" BASIS, WITHOUT WARRANTIES OR
+// CONDITIONS OF ANY KIND, either express or implied.
+//
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandPaths(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".git/HEAD":                "",
+		".gitignore":               "/build/\n*.tmp.md\n",
+		"README.md":                "",
+		"build/out.md":             "",
+		"docs/.gitignore":          "drafts\n!drafts/keep.md\ngenerated/\n",
+		"docs/a.md":                "",
+		"docs/b.mdx":               "",
+		"docs/notes.txt":           "",
+		"docs/wip.tmp.md":          "",
+		"docs/drafts":              "",
+		"docs/generated/x.md":      "",
+		"docs/guides/c.markdown":   "",
+		"docs/guides/d.md":         "",
+		"docs/guides/build/e.md":   "",
+		"docs/guides/generated.md": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	join := func(names ...string) []string {
+		var paths []string
+		for _, name := range names {
+			paths = append(paths, filepath.Join(root, filepath.FromSlash(name)))
+		}
+		return paths
+	}
+
+	defer func(exts []string) { extensions = exts }(extensions)
+
+	tc := []struct {
+		name  string
+		paths []string
+		exts  []string
+		files []string
+	}{
+		{name: "files are kept",
+			paths: join("README.md", "missing.md", "docs/notes.txt"),
+			files: join("README.md", "missing.md", "docs/notes.txt")},
+		{name: "directory",
+			paths: join("docs"),
+			files: join("docs/a.md", "docs/guides/build/e.md", "docs/guides/d.md", "docs/guides/generated.md")},
+		{name: "pattern",
+			paths: []string{filepath.ToSlash(filepath.Join(root, "docs", "guides")) + "/..."},
+			files: join("docs/guides/build/e.md", "docs/guides/d.md", "docs/guides/generated.md")},
+		{name: "whole repository",
+			paths: join(""),
+			files: join("README.md", "docs/a.md", "docs/guides/build/e.md", "docs/guides/d.md", "docs/guides/generated.md")},
+		{name: "duplicates",
+			paths: join("docs/a.md", "docs", "README.md", "docs/a.md"),
+			files: join("docs/a.md", "docs/guides/build/e.md", "docs/guides/d.md", "docs/guides/generated.md", "README.md")},
+		{name: "other extensions",
+			paths: join("docs"),
+			exts:  []string{".md", ".markdown", ".mdx"},
+			files: join("docs/a.md", "docs/b.mdx", "docs/guides/build/e.md", "docs/guides/c.markdown", "docs/guides/d.md", "docs/guides/generated.md")},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			extensions = []string{".md"}
+			if tt.exts != nil {
+				extensions = tt.exts
+			}
+			got, err := expandPaths(tt.paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.files) {
+				t.Errorf("expected files\n%q; got\n%q", tt.files, got)
+			}
+		})
+	}
+}